@@ -4,9 +4,14 @@ import (
 	"database/sql"
 	"fmt"
 	"reflect"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
 
 	sqlplus "github.com/cheetah-fun-gs/goplus/dao/sql"
+	mlogger "github.com/cheetah-fun-gs/goplus/multier/multilogger"
+	redigo "github.com/gomodule/redigo/redis"
 )
 
 type accessKeyCacher struct {
@@ -14,12 +19,27 @@ type accessKeyCacher struct {
 	tableUserAccessKey *modelTable // 访问密钥表
 }
 
-// Get 回源方法
+// 访问密钥缓存的查询方式
+const (
+	accessKeyByID    = "id"     // args: uid, accessKeyID
+	accessKeyByKeyID = "key_id" // args: keyID
+)
+
+// Get 回源方法 dest 为 *ModelUserAccessKey
 func (akc *accessKeyCacher) Get(dest interface{}, args ...interface{}) (bool, error) {
-	uid := args[0].(string)
-	aid := args[1].(int)
-	query := fmt.Sprintf("SELECT * FROM %v WHERE uid = ? AND id = ?;", akc.tableUserAccessKey.Name)
-	queryArgs := []interface{}{uid, aid}
+	var query string
+	var queryArgs []interface{}
+	switch args[0].(string) {
+	case accessKeyByID:
+		query = fmt.Sprintf("SELECT * FROM %v WHERE uid = ? AND id = ?;", akc.tableUserAccessKey.Name)
+		queryArgs = []interface{}{args[1].(string), args[2].(int)}
+	case accessKeyByKeyID:
+		query = fmt.Sprintf("SELECT * FROM %v WHERE key_id = ?;", akc.tableUserAccessKey.Name)
+		queryArgs = []interface{}{args[1].(string)}
+	default:
+		return false, fmt.Errorf("accessKeyCacher args is invalid")
+	}
+
 	rows, err := akc.db.Query(query, queryArgs...)
 	if err != nil {
 		return false, err
@@ -27,14 +47,16 @@ func (akc *accessKeyCacher) Get(dest interface{}, args ...interface{}) (bool, er
 	defer rows.Close()
 
 	result := &ModelUserAccessKey{}
-	if err = sqlplus.Get(rows, result); err != nil {
+	if err = sqlplus.Get(rows, result); err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
 		return false, err
 	}
 
 	if result.ExpireAt.Valid && result.ExpireAt.Time.Before(time.Now()) {
 		return false, fmt.Errorf("accessKey expired")
 	}
-	reflect.ValueOf(dest).Elem().Set(reflect.ValueOf(result.AccessKey))
+	reflect.ValueOf(dest).Elem().Set(reflect.ValueOf(result).Elem())
 	return true, nil
 }
 
@@ -47,3 +69,307 @@ func (akc *accessKeyCacher) Set(data interface{}, args ...interface{}) error {
 func (akc *accessKeyCacher) Del(args ...interface{}) error {
 	return nil
 }
+
+// getAccessKey 按uid和ID获取访问密钥 AccessKey 已解密
+func (mgr *UserMgr) getAccessKey(uid string, accessKeyID int) (bool, *ModelUserAccessKey, error) {
+	accessKey := &ModelUserAccessKey{}
+	ok, err := mgr.accessKeyCacher.Get(accessKey, accessKeyByID, uid, accessKeyID)
+	if err != nil || !ok {
+		return false, nil, err
+	}
+	if accessKey.AccessKey, _, err = mgr.openAccessKey(accessKey.KeyID, accessKey.AccessKey); err != nil {
+		return false, nil, err
+	}
+	return true, accessKey, nil
+}
+
+// getAccessKeyByKeyID 按公开的密钥ID获取访问密钥 AccessKey 已解密
+func (mgr *UserMgr) getAccessKeyByKeyID(keyID string) (bool, *ModelUserAccessKey, error) {
+	accessKey := &ModelUserAccessKey{}
+	ok, err := mgr.accessKeyCacher.Get(accessKey, accessKeyByKeyID, keyID)
+	if err != nil || !ok {
+		return false, nil, err
+	}
+	if accessKey.AccessKey, _, err = mgr.openAccessKey(accessKey.KeyID, accessKey.AccessKey); err != nil {
+		return false, nil, err
+	}
+	return true, accessKey, nil
+}
+
+// delAccessKeyCache 删除访问密钥的缓存
+func (mgr *UserMgr) delAccessKeyCache(uid string, accessKeyID int, keyID string) error {
+	if err := mgr.accessKeyCacher.Del(accessKeyByID, uid, accessKeyID); err != nil {
+		return err
+	}
+	return mgr.accessKeyCacher.Del(accessKeyByKeyID, keyID)
+}
+
+// sealAccessKey 使用当前主密钥加密访问密钥 密文与公开的密钥ID绑定, 密钥ID不能为空
+func (mgr *UserMgr) sealAccessKey(keyID, accessKey string) (string, error) {
+	if keyID == "" {
+		return "", fmt.Errorf("accessKey key_id is empty")
+	}
+	return mgr.seal(sealLabelAccessKey, keyID, accessKey)
+}
+
+// openAccessKey 解密访问密钥 未加密的旧数据原样返回
+// isCurrent 是否已使用当前主密钥加密, 为false时需要迁移
+func (mgr *UserMgr) openAccessKey(keyID, stored string) (accessKey string, isCurrent bool, err error) {
+	return mgr.open(sealLabelAccessKey, keyID, stored)
+}
+
+// maskAccessKey 只保留前4位
+func maskAccessKey(accessKey string) string {
+	if len(accessKey) <= 4 {
+		return "****"
+	}
+	return accessKey[:4] + "****"
+}
+
+// MigrateAccessKeys 把未加密或使用旧主密钥加密的访问密钥, 用当前主密钥重新加密 返回迁移的数量
+// 用于升级后加密已有数据和轮换主密钥, 可重复执行; 密文与 key_id 绑定, 存在 key_id 为空的数据时不迁移并返回错误
+func (mgr *UserMgr) MigrateAccessKeys() (int, error) {
+	query := fmt.Sprintf("SELECT id, uid, key_id, access_key FROM %v;", mgr.tableUserAccessKey.Name)
+	rows, err := mgr.db.Query(query)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	result := []*ModelUserAccessKey{}
+	for rows.Next() {
+		data := &ModelUserAccessKey{}
+		if err = rows.Scan(&data.ID, &data.UID, &data.KeyID, &data.AccessKey); err != nil {
+			return 0, err
+		}
+		result = append(result, data)
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, data := range result {
+		if data.KeyID == "" {
+			return 0, fmt.Errorf("accessKey %v key_id is empty, backfill key_id before migrating", data.ID)
+		}
+	}
+
+	count := 0
+	for _, data := range result {
+		accessKey, isCurrent, err := mgr.openAccessKey(data.KeyID, data.AccessKey)
+		if err != nil {
+			return count, err
+		}
+		if isCurrent {
+			continue
+		}
+
+		sealed, err := mgr.sealAccessKey(data.KeyID, accessKey)
+		if err != nil {
+			return count, err
+		}
+		// 只更新未被修改过的数据
+		queryUpdate := fmt.Sprintf("UPDATE %v SET access_key = ? WHERE id = ? AND access_key = ?;", mgr.tableUserAccessKey.Name)
+		argsUpdate := []interface{}{sealed, data.ID, data.AccessKey}
+		n, err := sqlplus.RowsAffected(mgr.db.Exec(queryUpdate, argsUpdate...))
+		if err != nil {
+			return count, err
+		}
+		if n == 0 {
+			continue
+		}
+		count++
+
+		if err = mgr.delAccessKeyCache(data.UID, data.ID, data.KeyID); err != nil {
+			mlogger.WarnN(mgr.mlogname, "MigrateAccessKeys delAccessKeyCache %v %v err: %v", data.UID, data.ID, err)
+		}
+	}
+	return count, nil
+}
+
+// Scopes 访问密钥的权限范围 如 read:profile、write:orders, 为空表示拥有用户的全部权限
+type Scopes []string
+
+// Has 是否拥有全部所需的权限
+func (s Scopes) Has(scopes ...string) bool {
+	if len(s) == 0 {
+		return true
+	}
+	for _, scope := range scopes {
+		found := false
+		for _, v := range s {
+			if v == scope {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// parseScopes 存储格式为空格分隔
+func parseScopes(scopes string) Scopes {
+	result := strings.Fields(scopes)
+	if len(result) == 0 {
+		return nil
+	}
+	return Scopes(result)
+}
+
+// formatScopes 去重并校验 权限范围不能为空或包含空白字符
+func formatScopes(scopes Scopes) (string, error) {
+	result := []string{}
+	seen := map[string]bool{}
+	for _, scope := range scopes {
+		if scope == "" || strings.IndexFunc(scope, unicode.IsSpace) >= 0 {
+			return "", fmt.Errorf("scope %q is invalid", scope)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			result = append(result, scope)
+		}
+	}
+	return strings.Join(result, " "), nil
+}
+
+func getAccessKeyUsageKey(name string, accessKeyID int) string {
+	return fmt.Sprintf("%s:accesskey:usage:%d", name, accessKeyID)
+}
+
+// 待写入数据库的访问密钥ID集合
+func getAccessKeyUsagePendingKey(name string) string {
+	return fmt.Sprintf("%s:accesskey:usage", name)
+}
+
+// 取出并删除使用记录
+// KEYS[1]: 使用记录key
+var takeAccessKeyUsageScript = redigo.NewScript(1, `local values = redis.call("HGETALL", KEYS[1])
+	redis.call("DEL", KEYS[1])
+	return values`)
+
+// accessKeyUsage 缓冲在Redis中的使用记录
+type accessKeyUsage struct {
+	id       int
+	lastUsed int64
+	lastIP   string
+	count    int64
+}
+
+// recordAccessKeyUsage 记录一次使用 先缓冲在Redis中, 由 FlushAccessKeyUsage 批量写入数据库
+func (mgr *UserMgr) recordAccessKeyUsage(accessKeyID int, ip string) {
+	conn := mgr.pool.Get()
+	defer conn.Close()
+
+	usageKey := getAccessKeyUsageKey(mgr.name, accessKeyID)
+	conn.Send("HMSET", usageKey, "last_used", time.Now().Unix(), "last_ip", ip)
+	conn.Send("HINCRBY", usageKey, "count", 1)
+	conn.Send("SADD", getAccessKeyUsagePendingKey(mgr.name), accessKeyID)
+	if err := conn.Flush(); err != nil {
+		mlogger.WarnN(mgr.mlogname, "recordAccessKeyUsage %v err: %v", accessKeyID, err)
+		return
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := conn.Receive(); err != nil {
+			mlogger.WarnN(mgr.mlogname, "recordAccessKeyUsage %v err: %v", accessKeyID, err)
+		}
+	}
+}
+
+// restoreAccessKeyUsage 写入数据库失败时放回Redis 等待下次写入
+func (mgr *UserMgr) restoreAccessKeyUsage(conn redigo.Conn, usages []*accessKeyUsage) {
+	for _, usage := range usages {
+		usageKey := getAccessKeyUsageKey(mgr.name, usage.id)
+		conn.Send("HSETNX", usageKey, "last_used", usage.lastUsed)
+		conn.Send("HSETNX", usageKey, "last_ip", usage.lastIP)
+		conn.Send("HINCRBY", usageKey, "count", usage.count)
+		conn.Send("SADD", getAccessKeyUsagePendingKey(mgr.name), usage.id)
+	}
+	if err := conn.Flush(); err != nil {
+		mlogger.WarnN(mgr.mlogname, "restoreAccessKeyUsage err: %v", err)
+		return
+	}
+	for i := 0; i < len(usages)*4; i++ {
+		if _, err := conn.Receive(); err != nil {
+			mlogger.WarnN(mgr.mlogname, "restoreAccessKeyUsage err: %v", err)
+		}
+	}
+}
+
+// FlushAccessKeyUsage 把缓冲在Redis中的访问密钥使用记录批量写入数据库 返回写入的密钥数量
+// 需定时调用; batchSizes 可选, 每批写入的密钥数量, 默认100
+func (mgr *UserMgr) FlushAccessKeyUsage(batchSizes ...int) (int, error) {
+	batchSize := 100
+	if len(batchSizes) > 0 && batchSizes[0] > 0 {
+		batchSize = batchSizes[0]
+	}
+
+	conn := mgr.pool.Get()
+	defer conn.Close()
+
+	total := 0
+	for {
+		ids, err := redigo.Ints(conn.Do("SPOP", getAccessKeyUsagePendingKey(mgr.name), batchSize))
+		if err != nil && err != redigo.ErrNil {
+			return total, err
+		}
+		if len(ids) == 0 {
+			return total, nil
+		}
+
+		usages := []*accessKeyUsage{}
+		for _, id := range ids {
+			values, err := redigo.StringMap(takeAccessKeyUsageScript.Do(conn, getAccessKeyUsageKey(mgr.name, id)))
+			if err != nil {
+				mlogger.WarnN(mgr.mlogname, "FlushAccessKeyUsage take %v err: %v", id, err)
+				continue
+			}
+			count, _ := strconv.ParseInt(values["count"], 10, 64)
+			if count == 0 {
+				continue
+			}
+			lastUsed, _ := strconv.ParseInt(values["last_used"], 10, 64)
+			usages = append(usages, &accessKeyUsage{
+				id:       id,
+				lastUsed: lastUsed,
+				lastIP:   values["last_ip"],
+				count:    count,
+			})
+		}
+
+		if err = mgr.saveAccessKeyUsage(usages); err != nil {
+			mlogger.WarnN(mgr.mlogname, "FlushAccessKeyUsage saveAccessKeyUsage err: %v", err)
+			mgr.restoreAccessKeyUsage(conn, usages)
+			return total, err
+		}
+		total += len(usages)
+
+		if len(ids) < batchSize {
+			return total, nil
+		}
+	}
+}
+
+// saveAccessKeyUsage 一批使用记录在一个事务中写入
+func (mgr *UserMgr) saveAccessKeyUsage(usages []*accessKeyUsage) error {
+	if len(usages) == 0 {
+		return nil
+	}
+
+	tx, err := mgr.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf("UPDATE %v SET last_used = ?, last_ip = ?, use_count = use_count + ? WHERE id = ?;",
+		mgr.tableUserAccessKey.Name)
+	for _, usage := range usages {
+		args := []interface{}{time.Unix(usage.lastUsed, 0), usage.lastIP, usage.count, usage.id}
+		if _, err = tx.Exec(query, args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,71 @@
+// Package breach 泄露密码检查
+package breach
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Checker 泄露密码检查定义
+type Checker interface {
+	IsBreached(rawPassword string) (bool, error) // 密码是否出现在已泄露的密码库中
+}
+
+// OfflineChecker 离线检查 使用本地的 SHA-1 前缀文件
+// 目录下每个文件以 SHA-1 的前5位(大写十六进制)命名, 每行为剩余35位和出现次数: SUFFIX:COUNT
+// 与 haveibeenpwned 的 range API 格式一致, 可用其官方下载工具生成
+type OfflineChecker struct {
+	dir      string
+	minCount int
+}
+
+// NewOfflineChecker 离线检查 minCounts 可选, 出现次数不少于该值才视为泄露, 默认1
+func NewOfflineChecker(dir string, minCounts ...int) *OfflineChecker {
+	minCount := 1
+	if len(minCounts) > 0 && minCounts[0] > 0 {
+		minCount = minCounts[0]
+	}
+	return &OfflineChecker{
+		dir:      dir,
+		minCount: minCount,
+	}
+}
+
+// IsBreached 密码是否出现在已泄露的密码库中
+func (checker *OfflineChecker) IsBreached(rawPassword string) (bool, error) {
+	sum := sha1.Sum([]byte(rawPassword))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	f, err := os.Open(filepath.Join(checker.dir, prefix))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		i := strings.IndexByte(line, ':')
+		if i < 0 || !strings.EqualFold(line[:i], suffix) {
+			continue
+		}
+		return parseCount(line[i+1:]) >= checker.minCount, nil
+	}
+	return false, scanner.Err()
+}
+
+func parseCount(s string) int {
+	count := 0
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			break
+		}
+		count = count*10 + int(c-'0')
+	}
+	return count
+}
@@ -1,19 +1,24 @@
 package gouser
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/cheetah-fun-gs/goplus/locker"
 	redigo "github.com/gomodule/redigo/redis"
 )
 
-func getCodeKey(name, code string, args ...interface{}) string {
-	splits := []string{name, code}
+// getCodeSceneKey 场景相关的key, 场景由args区分
+func getCodeSceneKey(name, suffix string, args ...interface{}) string {
+	splits := []string{name}
 	for _, arg := range args {
 		splits = append(splits, fmt.Sprintf("%v", arg))
 	}
-	splits = append(splits, "code")
+	splits = append(splits, "code", suffix)
 	return strings.Join(splits, ":")
 }
 
@@ -21,7 +26,73 @@ func getCodeLockKey(name, lockname string) string {
 	return fmt.Sprintf("%s:%s:code:lock", name, lockname)
 }
 
+// getCodeLockAccount 验证码失败次数的计数对象 按场景单独计数, 不与密码登录共用
+func getCodeLockAccount(parts ...string) string {
+	return "code:" + strings.Join(parts, ":")
+}
+
+// 消费验证码 哈希与读取时一致才删除, 防止同一验证码被并发使用两次
+// KEYS[1]: 验证码哈希key KEYS[2]: 失败次数key
+// ARGV[1]: 验证码哈希
+// 返回 1 通过; 0 不通过
+var consumeCodeScript = redigo.NewScript(2, `if redis.call("GET", KEYS[1]) == ARGV[1]
+	then
+		redis.call("DEL", KEYS[1], KEYS[2])
+		return 1
+	end
+	return 0`)
+
+// 保存新验证码 同时清除旧验证码的失败次数
+// KEYS[1]: 验证码哈希key KEYS[2]: 失败次数key
+// ARGV[1]: 验证码哈希 ARGV[2]: 过期时间
+var saveCodeScript = redigo.NewScript(2, `redis.call("SET", KEYS[1], ARGV[1], "EX", ARGV[2])
+	redis.call("DEL", KEYS[2])
+	return 1`)
+
+// 记录一次失败 失败次数达到上限后当前验证码失效
+// 过期时间只在第一次失败时设置, 持续失败不会延长
+// KEYS[1]: 验证码哈希key KEYS[2]: 失败次数key
+// ARGV[1]: 最大失败次数 ARGV[2]: 失败次数过期时间
+// 返回 0 不通过; -1 失败次数过多
+var failCodeScript = redigo.NewScript(2, `local fails = redis.call("INCR", KEYS[2])
+	if fails == 1
+	then
+		redis.call("EXPIRE", KEYS[2], ARGV[2])
+	end
+	if fails >= tonumber(ARGV[1])
+	then
+		redis.call("DEL", KEYS[1])
+		return -1
+	end
+	return 0`)
+
+// hashCode 验证码的哈希 与场景绑定, Redis中不保存明文
+func (mgr *UserMgr) hashCode(code string, args ...interface{}) string {
+	h := hmac.New(sha256.New, []byte(mgr.secret))
+	h.Write([]byte(getCodeSceneKey(mgr.name, "value", args...)))
+	h.Write([]byte(":"))
+	h.Write([]byte(code))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// setCode 生成并保存一个新验证码
+func (mgr *UserMgr) setCode(conn redigo.Conn, expire int, args ...interface{}) (string, error) {
+	code := mgr.generateCode()
+	if err := mgr.saveCode(conn, code, expire, args...); err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// saveCode 保存验证码的哈希 每个场景只有一个有效的验证码, 新验证码覆盖旧验证码并重新计算失败次数
+func (mgr *UserMgr) saveCode(conn redigo.Conn, code string, expire int, args ...interface{}) error {
+	_, err := saveCodeScript.Do(conn, getCodeSceneKey(mgr.name, "value", args...), getCodeSceneKey(mgr.name, "fail", args...),
+		mgr.hashCode(code, args...), expire)
+	return err
+}
+
 // ApplyCode 申请一个验证码, args用来区分场景
+// 每个场景只有一个有效的验证码, 新申请的验证码使旧验证码失效并重新计算失败次数; Redis中只保存验证码的HMAC
 func (mgr *UserMgr) ApplyCode(expire int, args ...interface{}) (code string, expire0 int, err error) {
 	if expire == 0 {
 		expire = mgr.config.CodeExpire
@@ -30,17 +101,7 @@ func (mgr *UserMgr) ApplyCode(expire int, args ...interface{}) (code string, exp
 	conn := mgr.pool.Get()
 	defer conn.Close()
 
-	code = mgr.generateCode()
-	codeKey := getCodeKey(mgr.name, code, args...)
-
-	var result string
-	result, err = redigo.String(conn.Do("SET", codeKey, "1", "EX", expire, "NX"))
-	if err != nil {
-		return
-	}
-
-	if result != "OK" {
-		err = fmt.Errorf("code duplicate")
+	if code, err = mgr.setCode(conn, expire, args...); err != nil {
 		return
 	}
 
@@ -67,17 +128,7 @@ func (mgr *UserMgr) ApplyCodeAntiReplay(lockname string, expire, retry int, args
 		return
 	}
 
-	code = mgr.generateCode()
-	codeKey := getCodeKey(mgr.name, code, args...)
-
-	var result string
-	result, err = redigo.String(conn.Do("SET", codeKey, "1", "EX", expire, "NX"))
-	if err != nil {
-		return
-	}
-
-	if result != "OK" {
-		err = fmt.Errorf("code duplicate")
+	if code, err = mgr.setCode(conn, expire, args...); err != nil {
 		return
 	}
 
@@ -86,14 +137,74 @@ func (mgr *UserMgr) ApplyCodeAntiReplay(lockname string, expire, retry int, args
 	return
 }
 
-// VerifyCode 申请验证码 args和ApplyCode时保持一致
+// VerifyCode 校验验证码 args和ApplyCode时保持一致
+// 验证码校验通过后立即失效; 同一场景失败次数达到上限后, 该场景的验证码失效, 返回 ErrorTooManyAttempts, 重新申请验证码后重新计数
+// 启用 LockThreshold 时, 失败次数计入该场景, 场景被锁定后返回 *LockedError
 func (mgr *UserMgr) VerifyCode(code string, args ...interface{}) (bool, error) {
+	splits := []string{}
+	for _, arg := range args {
+		splits = append(splits, fmt.Sprintf("%v", arg))
+	}
+	return mgr.verifyCode(getCodeLockAccount(splits...), "", code, args...)
+}
+
+// verifyCode 校验验证码 失败次数同时计入账号和IP 账号由 getCodeLockAccount 生成
+func (mgr *UserMgr) verifyCode(account, ip, code string, args ...interface{}) (bool, error) {
+	return mgr.verifyCodeBefore(account, ip, code, mgr.config.CodeExpire, nil, args...)
+}
+
+// verifyCodeBefore 校验验证码 验证码正确时先执行 before, 返回错误时验证码不消费也不计失败, 直接返回该错误
+// 用于只有持有正确验证码时才能进行的校验, 如新密码的强度和历史密码; expire 为验证码的有效期, 失败次数保留同样的时间
+func (mgr *UserMgr) verifyCodeBefore(account, ip, code string, expire int, before func() error, args ...interface{}) (bool, error) {
+	if err := mgr.checkLocked(account, ip); err != nil {
+		return false, err
+	}
+
 	conn := mgr.pool.Get()
 	defer conn.Close()
 
-	ok, err := redigo.Int(conn.Do("EXISTS", getCodeKey(mgr.name, code, args...)))
+	result, err := mgr.checkCode(conn, code, expire, before, args...)
 	if err != nil {
 		return false, err
 	}
-	return ok == 1, nil
+	if result < 0 {
+		return false, mgr.loginFailed(account, ip, ErrorTooManyAttempts)
+	}
+	if result == 0 {
+		return false, mgr.loginFailed(account, ip, nil)
+	}
+	mgr.onLoginSucceeded(account)
+	return true, nil
+}
+
+// checkCode 比较验证码哈希 返回 1 通过; 0 不通过; -1 失败次数过多
+func (mgr *UserMgr) checkCode(conn redigo.Conn, code string, expire int, before func() error, args ...interface{}) (int, error) {
+	valueKey := getCodeSceneKey(mgr.name, "value", args...)
+	failKey := getCodeSceneKey(mgr.name, "fail", args...)
+
+	values, err := redigo.Strings(conn.Do("MGET", valueKey, failKey))
+	if err != nil {
+		return 0, err
+	}
+	if fails, _ := strconv.Atoi(values[1]); fails >= mgr.config.CodeMaxAttempts {
+		return -1, nil
+	}
+
+	hash := mgr.hashCode(code, args...)
+	if values[0] != "" && hmac.Equal([]byte(values[0]), []byte(hash)) {
+		if before != nil {
+			if err = before(); err != nil {
+				return 0, err
+			}
+		}
+		ok, err := redigo.Int(consumeCodeScript.Do(conn, valueKey, failKey, hash))
+		if err != nil {
+			return 0, err
+		}
+		if ok == 1 {
+			return 1, nil
+		}
+	}
+
+	return redigo.Int(failCodeScript.Do(conn, valueKey, failKey, mgr.config.CodeMaxAttempts, expire))
 }
@@ -0,0 +1,74 @@
+// Package codesender 验证码发送 支持邮件、短信和用于测试的内存记录
+package codesender
+
+import (
+	"bytes"
+	"text/template"
+)
+
+// 发送渠道
+const (
+	ChannelEmail = "email" // 邮件
+	ChannelSMS   = "sms"   // 短信
+)
+
+// Message 消息
+type Message struct {
+	To      string `json:"to,omitempty"`      // 接收方 邮箱或手机号
+	Subject string `json:"subject,omitempty"` // 标题 短信忽略
+	Content string `json:"content,omitempty"` // 内容
+}
+
+// CodeSender 验证码发送器定义
+type CodeSender interface {
+	GetName() string         // 发送渠道 ChannelEmail 或 ChannelSMS
+	Send(msg *Message) error // 发送消息
+}
+
+// Template 消息模板 使用 text/template 语法
+type Template struct {
+	subject *template.Template
+	content *template.Template
+}
+
+// NewTemplate 获得一个消息模板 subject 可为空
+func NewTemplate(subject, content string) (*Template, error) {
+	subjectTemplate, err := template.New("subject").Parse(subject)
+	if err != nil {
+		return nil, err
+	}
+	contentTemplate, err := template.New("content").Parse(content)
+	if err != nil {
+		return nil, err
+	}
+	return &Template{
+		subject: subjectTemplate,
+		content: contentTemplate,
+	}, nil
+}
+
+// MustNewTemplate 获得一个消息模板 出错panic
+func MustNewTemplate(subject, content string) *Template {
+	t, err := NewTemplate(subject, content)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// Render 渲染消息
+func (t *Template) Render(to string, data interface{}) (*Message, error) {
+	subject := &bytes.Buffer{}
+	if err := t.subject.Execute(subject, data); err != nil {
+		return nil, err
+	}
+	content := &bytes.Buffer{}
+	if err := t.content.Execute(content, data); err != nil {
+		return nil, err
+	}
+	return &Message{
+		To:      to,
+		Subject: subject.String(),
+		Content: content.String(),
+	}, nil
+}
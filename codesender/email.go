@@ -0,0 +1,41 @@
+package codesender
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/smtp"
+)
+
+// EmailSender 邮件发送器 通过 SMTP 发送
+type EmailSender struct {
+	addr string // SMTP 服务地址 host:port
+	from string // 发件人
+	auth smtp.Auth
+}
+
+// NewEmailSender 获得一个邮件发送器 auth 可为nil
+func NewEmailSender(addr, from string, auth smtp.Auth) *EmailSender {
+	return &EmailSender{
+		addr: addr,
+		from: from,
+		auth: auth,
+	}
+}
+
+// GetName ...
+func (s *EmailSender) GetName() string {
+	return ChannelEmail
+}
+
+// Send ...
+func (s *EmailSender) Send(msg *Message) error {
+	body := &bytes.Buffer{}
+	fmt.Fprintf(body, "From: %s\r\n", s.from)
+	fmt.Fprintf(body, "To: %s\r\n", msg.To)
+	fmt.Fprintf(body, "Subject: %s\r\n", mime.BEncoding.Encode("UTF-8", msg.Subject))
+	fmt.Fprintf(body, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(body, "Content-Type: text/plain; charset=UTF-8\r\n")
+	fmt.Fprintf(body, "\r\n%s", msg.Content)
+	return smtp.SendMail(s.addr, s.auth, s.from, []string{msg.To}, body.Bytes())
+}
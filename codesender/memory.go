@@ -0,0 +1,58 @@
+package codesender
+
+import "sync"
+
+// MemorySender 内存发送器 仅记录消息, 用于测试
+type MemorySender struct {
+	name     string
+	mutex    sync.Mutex
+	messages []*Message
+}
+
+// NewMemorySender 获得一个内存发送器 name 为发送渠道
+func NewMemorySender(name string) *MemorySender {
+	return &MemorySender{name: name}
+}
+
+// GetName ...
+func (s *MemorySender) GetName() string {
+	return s.name
+}
+
+// Send ...
+func (s *MemorySender) Send(msg *Message) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.messages = append(s.messages, msg)
+	return nil
+}
+
+// Messages 已发送的全部消息
+func (s *MemorySender) Messages() []*Message {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]*Message{}, s.messages...)
+}
+
+// Last 最后一条发送给 to 的消息
+func (s *MemorySender) Last(to string) (*Message, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		if s.messages[i].To == to {
+			return s.messages[i], true
+		}
+	}
+	return nil, false
+}
+
+// Reset 清空消息
+func (s *MemorySender) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.messages = nil
+}
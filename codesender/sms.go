@@ -0,0 +1,21 @@
+package codesender
+
+// SMSSender 短信发送器 短信服务商各不相同, 由 send 方法对接
+type SMSSender struct {
+	send func(mobile, content string) error
+}
+
+// NewSMSSender 获得一个短信发送器
+func NewSMSSender(send func(mobile, content string) error) *SMSSender {
+	return &SMSSender{send: send}
+}
+
+// GetName ...
+func (s *SMSSender) GetName() string {
+	return ChannelSMS
+}
+
+// Send ...
+func (s *SMSSender) Send(msg *Message) error {
+	return s.send(msg.To, msg.Content)
+}
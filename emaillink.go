@@ -0,0 +1,154 @@
+// Package gouser 邮箱登录链接(magic link)
+package gouser
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cheetah-fun-gs/goplus/locker"
+	uuidplus "github.com/cheetah-fun-gs/goplus/uuid"
+	"github.com/cheetah-fun-gs/gouser/codesender"
+	"github.com/cheetah-fun-gs/gouser/tokenmgr"
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+// 登录链接错误
+var (
+	ErrorEmailLinkInvalid = fmt.Errorf("email link is invalid")
+)
+
+// emailLinkPayload 登录链接内容 绑定邮箱和来源
+type emailLinkPayload struct {
+	Email    string `json:"e"`
+	From     string `json:"f"`
+	Deadline int64  `json:"x"`
+	Nonce    string `json:"n"`
+}
+
+func getEmailLinkNonceKey(name, nonce string) string {
+	return fmt.Sprintf("%s:emaillink:%s", name, nonce)
+}
+
+func (mgr *UserMgr) signEmailLink(payload []byte) []byte {
+	h := hmac.New(sha256.New, []byte(mgr.secret))
+	h.Write([]byte("email_link:"))
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+// LoginEmailApplyLink 邮箱链接登录 申请登录链接令牌, 由应用拼接成链接
+// 令牌签名防篡改, 只能使用一次, 有效期与邮箱登录验证码(CodePurposeLoginEmail)相同; 与验证码共用限流, 超过限流返回 *RateLimitError
+func (mgr *UserMgr) LoginEmailApplyLink(email, from string, metas ...*tokenmgr.SessionMeta) (linkToken string, expire, retry int, err error) {
+	expire = mgr.getCodeSetting(CodePurposeLoginEmail).Expire
+	retry = mgr.config.CodeRetry
+
+	if err = mgr.CheckCodeRateLimit(email, metas...); err != nil {
+		return
+	}
+
+	conn := mgr.pool.Get()
+	defer conn.Close()
+
+	if err = locker.Lock(conn, getCodeLockKey(mgr.name, email), retry); err == locker.ErrorLocked {
+		err = ErrorLocked
+		return
+	} else if err != nil {
+		return
+	}
+
+	nonce := uuidplus.NewV4().Base62()
+	var payload []byte
+	if payload, err = json.Marshal(&emailLinkPayload{
+		Email:    email,
+		From:     from,
+		Deadline: time.Now().Unix() + int64(expire),
+		Nonce:    nonce,
+	}); err != nil {
+		return
+	}
+
+	if _, err = conn.Do("SET", getEmailLinkNonceKey(mgr.name, nonce), "1", "EX", expire); err != nil {
+		return
+	}
+
+	linkToken = base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(mgr.signEmailLink(payload))
+	return
+}
+
+// LoginEmailSendLink 邮箱链接登录 申请登录链接并直接发送到邮箱
+// baseURL 为前端登录页地址, 令牌以 token 参数附加在链接上, 前端取出后调用 LoginEmailLink
+func (mgr *UserMgr) LoginEmailSendLink(email, from, baseURL string, meta *tokenmgr.SessionMeta, locales ...string) (expire, retry int, err error) {
+	var linkToken string
+	if linkToken, expire, retry, err = mgr.LoginEmailApplyLink(email, from, meta); err != nil {
+		return
+	}
+
+	sep := "?"
+	if strings.Contains(baseURL, "?") {
+		sep = "&"
+	}
+	err = mgr.sendMessage(codesender.ChannelEmail, email, CodeTemplateLoginEmailLink, &CodeTemplateData{
+		Link:    baseURL + sep + "token=" + url.QueryEscape(linkToken),
+		Expire:  expire,
+		Minutes: (expire + 59) / 60,
+	}, locales...)
+	return
+}
+
+// parseEmailLink 校验登录链接令牌的签名和有效期
+func (mgr *UserMgr) parseEmailLink(linkToken string) (*emailLinkPayload, error) {
+	splits := strings.Split(linkToken, ".")
+	if len(splits) != 2 {
+		return nil, ErrorEmailLinkInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(splits[0])
+	if err != nil {
+		return nil, ErrorEmailLinkInvalid
+	}
+	sign, err := base64.RawURLEncoding.DecodeString(splits[1])
+	if err != nil {
+		return nil, ErrorEmailLinkInvalid
+	}
+	if !hmac.Equal(sign, mgr.signEmailLink(payload)) {
+		return nil, ErrorEmailLinkInvalid
+	}
+
+	result := &emailLinkPayload{}
+	if err = json.Unmarshal(payload, result); err != nil {
+		return nil, ErrorEmailLinkInvalid
+	}
+	if result.Email == "" || result.Nonce == "" || result.Deadline < time.Now().Unix() {
+		return nil, ErrorEmailLinkInvalid
+	}
+	return result, nil
+}
+
+// LoginEmailLink 邮箱链接登录 使用申请时的来源, 用户不存在时按 IsDisableEmailAutoRegister 决定是否自动注册
+// 用户启用了多因素认证时不返回token, 返回 *MFAChallenge 错误, 由 CompleteMFA 完成登录
+func (mgr *UserMgr) LoginEmailLink(linkToken string, metas ...*tokenmgr.SessionMeta) (user *User, token string, deadline int64, err error) {
+	var payload *emailLinkPayload
+	if payload, err = mgr.parseEmailLink(linkToken); err != nil {
+		return
+	}
+
+	conn := mgr.pool.Get()
+	defer conn.Close()
+
+	// 只能使用一次
+	var n int
+	if n, err = redigo.Int(conn.Do("DEL", getEmailLinkNonceKey(mgr.name, payload.Nonce))); err != nil {
+		return
+	} else if n == 0 {
+		err = ErrorEmailLinkInvalid
+		return
+	}
+
+	return mgr.loginEmail(payload.Email, payload.From, metas...)
+}
@@ -0,0 +1,36 @@
+package gouser
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoginEmailApplyLinkExpire(t *testing.T) {
+	mgr, _, mr, closer := newTestMgrWithRedis(t, Config{
+		CodeExpire:   300,
+		CodeSettings: map[CodePurpose]*CodeSetting{CodePurposeLoginEmail: {Expire: 900}},
+	})
+	defer closer()
+
+	linkToken, expire, _, err := mgr.LoginEmailApplyLink("test@example.com", fromDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if linkToken == "" || expire != 900 {
+		t.Errorf("LoginEmailApplyLink = %q %v, want expire 900", linkToken, expire)
+	}
+
+	// 随机数按邮箱登录验证码的有效期保存
+	found := false
+	for _, key := range mr.Keys() {
+		if strings.HasPrefix(key, "test:emaillink:") {
+			found = true
+			if ttl := mr.TTL(key); ttl.Seconds() != 900 {
+				t.Errorf("TTL(%v) = %v, want 900s", key, ttl)
+			}
+		}
+	}
+	if !found {
+		t.Error("email link nonce is not saved")
+	}
+}
@@ -6,6 +6,18 @@ import (
 
 // 常用错误
 var (
-	ErrorNotFound = fmt.Errorf("not found")
-	ErrorLocked   = fmt.Errorf("locked")
+	ErrorNotFound        = fmt.Errorf("not found")
+	ErrorLocked          = fmt.Errorf("locked")
+	ErrorTooManyAttempts = fmt.Errorf("too many attempts")
+	ErrorRateLimited     = fmt.Errorf("rate limited")
+	ErrorTokenInvalid    = fmt.Errorf("token is invalid")
+	ErrorCodeInvalid     = fmt.Errorf("code is invalid")
+	ErrorPasswordWrong   = fmt.Errorf("password is wrong")
+	ErrorPasswordWeak    = fmt.Errorf("password is weak")
+	ErrorPasswordReused  = fmt.Errorf("password is reused")
+	ErrorPasswordExpired = fmt.Errorf("password is expired")
+	ErrorMFARequired     = fmt.Errorf("mfa required")
+	ErrorMFAInvalid      = fmt.Errorf("mfa challenge is invalid")
+	ErrorMFACodeWrong    = fmt.Errorf("mfa code is wrong")
+	ErrorMFAEnabled      = fmt.Errorf("mfa is enabled")
 )
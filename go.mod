@@ -3,7 +3,10 @@ module github.com/cheetah-fun-gs/gouser
 go 1.13
 
 require (
+	github.com/DATA-DOG/go-sqlmock v1.5.0
+	github.com/alicebob/miniredis/v2 v2.30.0
 	github.com/cheetah-fun-gs/goplus v1.2.1
 	github.com/go-sql-driver/mysql v1.5.0
 	github.com/gomodule/redigo v2.0.0+incompatible
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 )
@@ -0,0 +1,49 @@
+// Package keyprovider 主密钥提供者 用于加密存储的敏感数据(如访问密钥、TOTP密钥)
+// 可接入 KMS 等外部服务, 只需实现 Provider
+package keyprovider
+
+import (
+	"fmt"
+)
+
+// 错误
+var (
+	ErrorKeyNotFound = fmt.Errorf("key not found")
+)
+
+// Provider 主密钥提供者定义 支持轮换: 新数据使用当前密钥加密, 旧密钥依然可以解密
+type Provider interface {
+	Current() (keyID string, key []byte, err error) // 当前用于加密的主密钥
+	Get(keyID string) ([]byte, error)               // 按ID获取主密钥 用于解密
+}
+
+// StaticProvider 静态主密钥 密钥保存在内存中
+type StaticProvider struct {
+	current string
+	keys    map[string][]byte
+}
+
+// NewStaticProvider 静态主密钥 current 为当前用于加密的密钥ID, 必须在 keys 中
+func NewStaticProvider(current string, keys map[string][]byte) *StaticProvider {
+	if _, ok := keys[current]; !ok {
+		panic("current key is not in keys")
+	}
+	return &StaticProvider{
+		current: current,
+		keys:    keys,
+	}
+}
+
+// Current ...
+func (p *StaticProvider) Current() (string, []byte, error) {
+	return p.current, p.keys[p.current], nil
+}
+
+// Get ...
+func (p *StaticProvider) Get(keyID string) ([]byte, error) {
+	key, ok := p.keys[keyID]
+	if !ok {
+		return nil, ErrorKeyNotFound
+	}
+	return key, nil
+}
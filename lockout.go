@@ -0,0 +1,210 @@
+// Package gouser 防暴力破解 按账号和IP计数失败次数, 达到阈值后锁定, 锁定时长逐次翻倍
+package gouser
+
+import (
+	"fmt"
+	"time"
+
+	mlogger "github.com/cheetah-fun-gs/goplus/multier/multilogger"
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+// 锁定对象
+const (
+	lockSubjectAccount = "account"
+	lockSubjectIP      = "ip"
+)
+
+// LockedError 账号或IP被锁定 RetryAfter 秒后可重试
+// errors.Is(err, ErrorLocked) 为 true
+type LockedError struct {
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%v, retry after %v seconds", ErrorLocked.Error(), e.RetryAfter)
+}
+
+// Unwrap ...
+func (e *LockedError) Unwrap() error {
+	return ErrorLocked
+}
+
+// LockStatus 锁定状态
+type LockStatus struct {
+	Fails      int `json:"fails,omitempty"`       // 当前的连续失败次数
+	Level      int `json:"level,omitempty"`       // 已锁定次数 决定下次锁定时长
+	RetryAfter int `json:"retry_after,omitempty"` // 剩余锁定时间 为0表示未锁定
+}
+
+func getLockKey(name, subject, value string) string {
+	return fmt.Sprintf("%s:lock:%s:%s", name, subject, value)
+}
+
+// 记录一次失败 返回本次触发的锁定时长, 未触发返回0
+// KEYS[1]: 锁定key
+// ARGV[1]: 阈值 ARGV[2]: 首次锁定时长 ARGV[3]: 最长锁定时长 ARGV[4]: 计数窗口 ARGV[5]: 当前时间
+var lockFailScript = redigo.NewScript(1, `local fails = redis.call("HINCRBY", KEYS[1], "fails", 1)
+	local now = tonumber(ARGV[5])
+	local duration = 0
+	if fails >= tonumber(ARGV[1])
+	then
+		local level = redis.call("HINCRBY", KEYS[1], "level", 1)
+		duration = tonumber(ARGV[2])
+		for i = 2, level do
+			duration = duration * 2
+			if duration >= tonumber(ARGV[3])
+			then
+				break
+			end
+		end
+		if duration > tonumber(ARGV[3])
+		then
+			duration = tonumber(ARGV[3])
+		end
+		redis.call("HMSET", KEYS[1], "fails", 0, "until", now + duration)
+	end
+	local ttl = tonumber(ARGV[4])
+	local lockUntil = tonumber(redis.call("HGET", KEYS[1], "until") or "0")
+	if lockUntil > now
+	then
+		ttl = ttl + lockUntil - now
+	end
+	redis.call("EXPIRE", KEYS[1], ttl)
+	return duration`)
+
+func (mgr *UserMgr) getLockThreshold(subject string) int {
+	if subject == lockSubjectIP {
+		return mgr.config.LockIPThreshold
+	}
+	return mgr.config.LockThreshold
+}
+
+func (mgr *UserMgr) getLockStatus(conn redigo.Conn, subject, value string) (*LockStatus, error) {
+	values, err := redigo.Ints(conn.Do("HMGET", getLockKey(mgr.name, subject, value), "fails", "level", "until"))
+	if err != nil {
+		return nil, err
+	}
+
+	status := &LockStatus{
+		Fails: values[0],
+		Level: values[1],
+	}
+	if now := int(time.Now().Unix()); values[2] > now {
+		status.RetryAfter = values[2] - now
+	}
+	return status, nil
+}
+
+// checkLocked 登录前检查 账号或IP被锁定时返回 *LockedError
+func (mgr *UserMgr) checkLocked(account, ip string) error {
+	conn := mgr.pool.Get()
+	defer conn.Close()
+
+	retryAfter := 0
+	for subject, value := range map[string]string{lockSubjectAccount: account, lockSubjectIP: ip} {
+		if value == "" || mgr.getLockThreshold(subject) <= 0 {
+			continue
+		}
+		status, err := mgr.getLockStatus(conn, subject, value)
+		if err != nil {
+			return err
+		}
+		if status.RetryAfter > retryAfter {
+			retryAfter = status.RetryAfter
+		}
+	}
+
+	if retryAfter > 0 {
+		return &LockedError{RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+// onLoginFailed 记录登录失败 本次失败触发锁定时返回 *LockedError
+func (mgr *UserMgr) onLoginFailed(account, ip string) error {
+	conn := mgr.pool.Get()
+	defer conn.Close()
+
+	now := time.Now().Unix()
+	retryAfter := 0
+	for subject, value := range map[string]string{lockSubjectAccount: account, lockSubjectIP: ip} {
+		threshold := mgr.getLockThreshold(subject)
+		if value == "" || threshold <= 0 {
+			continue
+		}
+		duration, err := redigo.Int(lockFailScript.Do(conn, getLockKey(mgr.name, subject, value),
+			threshold, mgr.config.LockDuration, mgr.config.LockMaxDuration, mgr.config.LockWindow, now))
+		if err != nil {
+			return err
+		}
+		if duration > retryAfter {
+			retryAfter = duration
+		}
+	}
+
+	if retryAfter > 0 {
+		return &LockedError{RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+// onLoginSucceeded 登录成功 清除账号的失败记录, IP的失败记录不清除
+func (mgr *UserMgr) onLoginSucceeded(account string) {
+	if mgr.config.LockThreshold <= 0 || account == "" {
+		return
+	}
+
+	conn := mgr.pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("DEL", getLockKey(mgr.name, lockSubjectAccount, account)); err != nil {
+		mlogger.WarnN(mgr.mlogname, "onLoginSucceeded DEL %v err: %v", account, err)
+	}
+}
+
+// loginFailed 处理登录失败 触发锁定时返回 *LockedError, 否则返回原错误
+func (mgr *UserMgr) loginFailed(account, ip string, err error) error {
+	if errLock := mgr.onLoginFailed(account, ip); errLock != nil {
+		if _, ok := errLock.(*LockedError); ok {
+			return errLock
+		}
+		mlogger.WarnN(mgr.mlogname, "onLoginFailed %v %v err: %v", account, ip, errLock)
+	}
+	return err
+}
+
+// GetAccountLock 获得账号的锁定状态 account 为登录时使用的uid/邮箱/手机号
+// 验证码按用途单独计数, account 为 code:<用途>:<账号>, 如 code:login_mobile:13800000000
+func (mgr *UserMgr) GetAccountLock(account string) (*LockStatus, error) {
+	conn := mgr.pool.Get()
+	defer conn.Close()
+
+	return mgr.getLockStatus(conn, lockSubjectAccount, account)
+}
+
+// ClearAccountLock 解除账号的锁定并清除失败记录
+func (mgr *UserMgr) ClearAccountLock(account string) error {
+	conn := mgr.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", getLockKey(mgr.name, lockSubjectAccount, account))
+	return err
+}
+
+// GetIPLock 获得IP的锁定状态
+func (mgr *UserMgr) GetIPLock(ip string) (*LockStatus, error) {
+	conn := mgr.pool.Get()
+	defer conn.Close()
+
+	return mgr.getLockStatus(conn, lockSubjectIP, ip)
+}
+
+// ClearIPLock 解除IP的锁定并清除失败记录
+func (mgr *UserMgr) ClearIPLock(ip string) error {
+	conn := mgr.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", getLockKey(mgr.name, lockSubjectIP, ip))
+	return err
+}
@@ -1,7 +1,10 @@
 // Package gouser 登录并注册
 package gouser
 
-import "fmt"
+import (
+	"github.com/cheetah-fun-gs/gouser/codesender"
+	"github.com/cheetah-fun-gs/gouser/tokenmgr"
+)
 
 // LoginTourist 游客登录
 func (mgr *UserMgr) LoginTourist() (user *User, token string, deadline int64, err error) {
@@ -9,12 +12,12 @@ func (mgr *UserMgr) LoginTourist() (user *User, token string, deadline int64, er
 }
 
 // LoginTouristWithFrom 游客登录 带来源
-func (mgr *UserMgr) LoginTouristWithFrom(from string) (user *User, token string, deadline int64, err error) {
+func (mgr *UserMgr) LoginTouristWithFrom(from string, metas ...*tokenmgr.SessionMeta) (user *User, token string, deadline int64, err error) {
 	user, err = mgr.RegisterTourist()
 	if err != nil {
 		return
 	}
-	if token, deadline, err = user.LoginWithFrom(from); err != nil {
+	if token, deadline, err = user.LoginWithFrom(from, metas...); err != nil {
 		return nil, "", 0, err
 	}
 	return
@@ -26,29 +29,69 @@ func (mgr *UserMgr) LoginLAPD(uid, rawPassword string) (user *User, token string
 }
 
 // LoginLAPDWithFrom 密码登录 带来源
-func (mgr *UserMgr) LoginLAPDWithFrom(uid, rawPassword, from string) (user *User, token string, deadline int64, err error) {
+// 用户启用了多因素认证时不返回token, 返回 *MFAChallenge 错误, 由 CompleteMFA 完成登录
+// 密码已过期时不返回token, 通过多因素认证后才返回 user 和 ErrorPasswordExpired, 需先通过 UpdatePasswordWithPassword 修改密码
+// 启用 LockThreshold/LockIPThreshold 时, 账号或IP被锁定返回 *LockedError
+// 禁止自动注册时, 用户不存在与密码错误一样返回 ErrorPasswordWrong 并计入失败次数
+func (mgr *UserMgr) LoginLAPDWithFrom(uid, rawPassword, from string, metas ...*tokenmgr.SessionMeta) (user *User, token string, deadline int64, err error) {
+	ip := tokenmgr.GetMeta(metas...).IP
+	if err = mgr.checkLocked(uid, ip); err != nil {
+		return
+	}
+
 	var ok bool
 	ok, user, err = mgr.FindUserByUID(uid)
 	if err != nil {
 		return
 	}
 
-	if !ok {
+	if ok {
+		if err = mgr.checkPassword(user.ID, rawPassword); err != nil {
+			if err == ErrorPasswordWrong {
+				err = mgr.loginFailed(uid, ip, err)
+			}
+			return nil, "", 0, err
+		}
+	} else {
+		if mgr.config.IsDisableLAPDAutoRegister {
+			// 与密码错误不可区分, 防止枚举用户
+			return nil, "", 0, mgr.loginFailed(uid, ip, ErrorPasswordWrong)
+		}
 		user, err = mgr.RegisterLAPD(uid, rawPassword)
 		if err != nil {
 			return
 		}
 	}
 
-	if token, deadline, err = user.LoginWithFrom(from); err != nil {
+	// 先完成多因素认证, 再检查密码是否过期; 需要二次验证时由 completeMFA 清除失败记录
+	token, deadline, err = mgr.loginWithMFA(user, from, ok, metas...)
+	if err == nil || err == ErrorPasswordExpired {
+		mgr.onLoginSucceeded(uid)
+	}
+	if err == ErrorPasswordExpired {
+		return user, "", 0, err
+	} else if err != nil {
 		return nil, "", 0, err
 	}
 	return
 }
 
-// LoginMobileApplyCode 手机验证码登录 申请验证码
-func (mgr *UserMgr) LoginMobileApplyCode(mobile string) (code string, expire, retry int, err error) {
-	return mgr.ApplyCodeAntiReplay(mobile, 0, 0, mobile)
+// LoginMobileApplyCode 手机验证码登录 申请验证码 超过限流返回 *RateLimitError
+func (mgr *UserMgr) LoginMobileApplyCode(mobile string, metas ...*tokenmgr.SessionMeta) (code string, expire, retry int, err error) {
+	if err = mgr.CheckCodeRateLimit(mobile, metas...); err != nil {
+		return
+	}
+	return mgr.applyPurposeCode(CodePurposeLoginMobile, mobile, mobile)
+}
+
+// LoginMobileSendCode 手机验证码登录 申请验证码并直接发送到手机
+func (mgr *UserMgr) LoginMobileSendCode(mobile string, meta *tokenmgr.SessionMeta, locales ...string) (expire, retry int, err error) {
+	var code string
+	if code, expire, retry, err = mgr.LoginMobileApplyCode(mobile, meta); err != nil {
+		return
+	}
+	err = mgr.sendCode(codesender.ChannelSMS, mobile, CodeTemplateLoginMobile, code, expire, locales...)
+	return
 }
 
 // LoginMobile 手机验证码登录
@@ -57,14 +100,16 @@ func (mgr *UserMgr) LoginMobile(mobile, code string) (user *User, token string,
 }
 
 // LoginMobileWithFrom 手机验证码登录 带来源
-func (mgr *UserMgr) LoginMobileWithFrom(mobile, code, from string) (user *User, token string, deadline int64, err error) {
+// 用户启用了多因素认证时不返回token, 返回 *MFAChallenge 错误, 由 CompleteMFA 完成登录
+// 启用 LockThreshold/LockIPThreshold 时, 手机号或IP被锁定返回 *LockedError
+func (mgr *UserMgr) LoginMobileWithFrom(mobile, code, from string, metas ...*tokenmgr.SessionMeta) (user *User, token string, deadline int64, err error) {
 	var ok bool
-	ok, err = mgr.VerifyCode(code, mobile)
+	ok, err = mgr.verifyPurposeCode(mobile, tokenmgr.GetMeta(metas...).IP, code, CodePurposeLoginMobile, mobile)
 	if err != nil {
 		return
 	}
 	if !ok {
-		err = fmt.Errorf("code is invalid")
+		err = ErrorCodeInvalid
 		return
 	}
 
@@ -74,13 +119,82 @@ func (mgr *UserMgr) LoginMobileWithFrom(mobile, code, from string) (user *User,
 	}
 
 	if !ok {
+		if mgr.config.IsDisableMobileAutoRegister {
+			err = ErrorNotFound
+			return
+		}
 		user, err = mgr.registerMobile(mobile)
 		if err != nil {
 			return
 		}
 	}
 
-	if token, deadline, err = user.LoginWithFrom(from); err != nil {
+	if token, deadline, err = mgr.loginWithMFA(user, from, false, metas...); err != nil {
+		return nil, "", 0, err
+	}
+	return
+}
+
+// LoginEmailApplyCode 邮箱验证码登录 申请验证码 超过限流返回 *RateLimitError
+func (mgr *UserMgr) LoginEmailApplyCode(email string, metas ...*tokenmgr.SessionMeta) (code string, expire, retry int, err error) {
+	if err = mgr.CheckCodeRateLimit(email, metas...); err != nil {
+		return
+	}
+	return mgr.applyPurposeCode(CodePurposeLoginEmail, email, email)
+}
+
+// LoginEmailSendCode 邮箱验证码登录 申请验证码并直接发送到邮箱
+func (mgr *UserMgr) LoginEmailSendCode(email string, meta *tokenmgr.SessionMeta, locales ...string) (expire, retry int, err error) {
+	var code string
+	if code, expire, retry, err = mgr.LoginEmailApplyCode(email, meta); err != nil {
+		return
+	}
+	err = mgr.sendCode(codesender.ChannelEmail, email, CodeTemplateLoginEmail, code, expire, locales...)
+	return
+}
+
+// LoginEmail 邮箱验证码登录
+func (mgr *UserMgr) LoginEmail(email, code string) (user *User, token string, deadline int64, err error) {
+	return mgr.LoginEmailWithFrom(email, code, fromDefault)
+}
+
+// LoginEmailWithFrom 邮箱验证码登录 带来源
+// 用户启用了多因素认证时不返回token, 返回 *MFAChallenge 错误, 由 CompleteMFA 完成登录
+// 启用 LockThreshold/LockIPThreshold 时, 邮箱或IP被锁定返回 *LockedError
+func (mgr *UserMgr) LoginEmailWithFrom(email, code, from string, metas ...*tokenmgr.SessionMeta) (user *User, token string, deadline int64, err error) {
+	var ok bool
+	ok, err = mgr.verifyPurposeCode(email, tokenmgr.GetMeta(metas...).IP, code, CodePurposeLoginEmail, email)
+	if err != nil {
+		return
+	}
+	if !ok {
+		err = ErrorCodeInvalid
+		return
+	}
+
+	return mgr.loginEmail(email, from, metas...)
+}
+
+// loginEmail 邮箱已验证 登录, 用户不存在时自动注册
+func (mgr *UserMgr) loginEmail(email, from string, metas ...*tokenmgr.SessionMeta) (user *User, token string, deadline int64, err error) {
+	var ok bool
+	ok, user, err = mgr.FindUserByEmail(email)
+	if err != nil {
+		return
+	}
+
+	if !ok {
+		if mgr.config.IsDisableEmailAutoRegister {
+			err = ErrorNotFound
+			return
+		}
+		user, err = mgr.registerEmail(email)
+		if err != nil {
+			return
+		}
+	}
+
+	if token, deadline, err = mgr.loginWithMFA(user, from, false, metas...); err != nil {
 		return nil, "", 0, err
 	}
 	return
@@ -92,7 +206,7 @@ func (mgr *UserMgr) LoginAuth(authName string, v interface{}) (user *User, token
 }
 
 // LoginAuthWithFrom 第三方登录 带来源
-func (mgr *UserMgr) LoginAuthWithFrom(authName string, v interface{}, from string) (user *User, token string, deadline int64, err error) {
+func (mgr *UserMgr) LoginAuthWithFrom(authName string, v interface{}, from string, metas ...*tokenmgr.SessionMeta) (user *User, token string, deadline int64, err error) {
 	var authUID, authExtra string
 	authUID, authExtra, err = mgr.VerifyAuth(authName, v)
 	if err != nil {
@@ -112,7 +226,7 @@ func (mgr *UserMgr) LoginAuthWithFrom(authName string, v interface{}, from strin
 		}
 	}
 
-	if token, deadline, err = user.LoginWithFrom(from); err != nil {
+	if token, deadline, err = user.LoginWithFrom(from, metas...); err != nil {
 		return nil, "", 0, err
 	}
 	return
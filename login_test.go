@@ -0,0 +1,135 @@
+package gouser
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cheetah-fun-gs/gouser/passwordhasher"
+)
+
+// argon2idArg 匹配 argon2id 哈希 并记录匹配到的值
+type argon2idArg struct {
+	value string
+}
+
+func (a *argon2idArg) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	if ok && strings.HasPrefix(s, "$argon2id$") {
+		a.value = s
+		return true
+	}
+	return false
+}
+
+// newTestPasswordMgr 用户已在缓存中的管理器
+func newTestPasswordMgr(t *testing.T) (*UserMgr, sqlmock.Sqlmock, func()) {
+	mgr, mock, mr, closer := newTestMgrWithRedis(t, Config{})
+	mgr.SetPasswordHasher(&passwordhasher.Argon2idHasher{Time: 1, Memory: 64, Threads: 1, SaltLen: 16, KeyLen: 32})
+	mock.ExpectQuery(`SELECT \* FROM test_user WHERE uid = \?;`).WithArgs(testUID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "uid"}).AddRow(1, testUID))
+	if ok, _, err := mgr.FindUserByUID(testUID); err != nil || !ok {
+		closer()
+		t.Fatalf("FindUserByUID = %v %v", ok, err)
+	}
+	// 回源的守护锁到期后才能写缓存, miniredis 需手动推进时间
+	mr.FastForward(time.Second)
+	return mgr, mock, closer
+}
+
+func expectPassword(mock sqlmock.Sqlmock, password string) {
+	mock.ExpectQuery(`SELECT password FROM test_user WHERE id = \?;`).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(password))
+}
+
+func expectLastLogin(mock sqlmock.Sqlmock) {
+	mock.ExpectExec(`UPDATE test_user Set last_login = \?, updated = \? WHERE id = \?;`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestLoginLAPDRehashLegacy(t *testing.T) {
+	mgr, mock, closer := newTestPasswordMgr(t)
+	defer closer()
+
+	legacy := mgr.getLegacyPassword("p@ssw0rd")
+	expectPassword(mock, legacy)
+	rehashed := &argon2idArg{}
+	mock.ExpectExec(`UPDATE test_user Set password = \? WHERE id = \? AND password = \?;`).
+		WithArgs(rehashed, 1, legacy).WillReturnResult(sqlmock.NewResult(0, 1))
+	expectLastLogin(mock)
+
+	user, token, _, err := mgr.LoginLAPD(testUID, "p@ssw0rd")
+	if err != nil {
+		t.Fatalf("LoginLAPD legacy err: %v", err)
+	}
+	if user == nil || user.UID != testUID || token == "" {
+		t.Fatalf("LoginLAPD legacy = %+v %q", user, token)
+	}
+	if ok, err := passwordhasher.Verify("p@ssw0rd", rehashed.value); err != nil || !ok {
+		t.Errorf("rehashed password %q Verify = %v %v, want true", rehashed.value, ok, err)
+	}
+
+	// 升级后的哈希再次校验 不再升级
+	expectPassword(mock, rehashed.value)
+	if err = mgr.checkPassword(1, "p@ssw0rd"); err != nil {
+		t.Fatalf("checkPassword rehashed err: %v", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoginLAPDLegacyWrongPassword(t *testing.T) {
+	mgr, mock, closer := newTestPasswordMgr(t)
+	defer closer()
+
+	expectPassword(mock, mgr.getLegacyPassword("p@ssw0rd"))
+	if user, _, _, err := mgr.LoginLAPD(testUID, "wrong"); err != ErrorPasswordWrong || user != nil {
+		t.Errorf("LoginLAPD wrong password = %+v %v, want nil %v", user, err, ErrorPasswordWrong)
+	}
+
+	// 不会升级密码
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoginLAPDMalformedPassword(t *testing.T) {
+	mgr, mock, closer := newTestPasswordMgr(t)
+	defer closer()
+
+	expectPassword(mock, "$argon2id$v=19$m=64,t=0,p=0$$")
+	if user, _, _, err := mgr.LoginLAPD(testUID, "p@ssw0rd"); err != passwordhasher.ErrorMalformed || user != nil {
+		t.Errorf("LoginLAPD malformed password = %+v %v, want nil %v", user, err, passwordhasher.ErrorMalformed)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoginLAPDUnknownUser(t *testing.T) {
+	mgr, mock, closer := newTestMgr(t, Config{IsDisableLAPDAutoRegister: true, LockThreshold: 2})
+	defer closer()
+
+	// 不存在的用户 与密码错误一样计入失败次数
+	mock.ExpectQuery(`SELECT \* FROM test_user WHERE uid = \?;`).WithArgs("nobody").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "uid"}))
+	if user, _, _, err := mgr.LoginLAPD("nobody", "p@ssw0rd"); err != ErrorPasswordWrong || user != nil {
+		t.Errorf("LoginLAPD unknown user = %+v %v, want nil %v", user, err, ErrorPasswordWrong)
+	}
+	if _, _, _, err := mgr.LoginLAPD("nobody", "p@ssw0rd"); !errors.Is(err, ErrorLocked) {
+		t.Errorf("LoginLAPD unknown user again err = %v, want %v", err, ErrorLocked)
+	}
+	if _, _, _, err := mgr.LoginLAPD("nobody", "p@ssw0rd"); !errors.Is(err, ErrorLocked) {
+		t.Errorf("LoginLAPD locked user err = %v, want %v", err, ErrorLocked)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,469 @@
+// Package gouser 多因素认证
+package gouser
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	sqlplus "github.com/cheetah-fun-gs/goplus/dao/sql"
+	mlogger "github.com/cheetah-fun-gs/goplus/multier/multilogger"
+	uuidplus "github.com/cheetah-fun-gs/goplus/uuid"
+	"github.com/cheetah-fun-gs/gouser/tokenmgr"
+	"github.com/cheetah-fun-gs/gouser/totp"
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+// 多因素认证类型
+const (
+	MFATypeTOTP = "totp"
+)
+
+// totp 允许前后偏差的步数
+const totpSkew = 1
+
+// MFAChallenge 登录需要二次验证 作为错误返回, errors.Is(err, ErrorMFARequired) 为 true
+type MFAChallenge struct {
+	ID     string `json:"id,omitempty"`     // 挑战ID 传给 CompleteMFA
+	Expire int    `json:"expire,omitempty"` // 有效期
+}
+
+func (c *MFAChallenge) Error() string {
+	return ErrorMFARequired.Error()
+}
+
+// Unwrap ...
+func (c *MFAChallenge) Unwrap() error {
+	return ErrorMFARequired
+}
+
+type mfaChallengeValue struct {
+	UID                    string                `json:"uid,omitempty"`
+	From                   string                `json:"from,omitempty"`
+	Meta                   *tokenmgr.SessionMeta `json:"meta,omitempty"`
+	IsCheckPasswordExpired bool                  `json:"check_password_expired,omitempty"` // 密码登录 通过后检查密码是否过期
+}
+
+func getMFAChallengeKey(name, challengeID string) string {
+	return fmt.Sprintf("%s:mfa:challenge:%s", name, challengeID)
+}
+
+func getTOTPUsedKey(name, uid string, step int64) string {
+	return fmt.Sprintf("%s:%s:mfa:totp:%d", name, uid, step)
+}
+
+// 记录一次失败 挑战不存在返回-1, 失败次数达到上限时删除挑战并返回0, 否则返回剩余次数
+// KEYS[1]: 挑战key ARGV[1]: 最大失败次数
+var failMFAChallengeScript = redigo.NewScript(1, `if redis.call("EXISTS", KEYS[1]) == 0
+	then
+		return -1
+	end
+	local fails = redis.call("HINCRBY", KEYS[1], "fails", 1)
+	if fails >= tonumber(ARGV[1])
+	then
+		redis.call("DEL", KEYS[1])
+		return 0
+	end
+	return tonumber(ARGV[1]) - fails`)
+
+// loginWithMFA 登录 用户启用了多因素认证时返回挑战
+// isCheckPasswordExpired 为 true 时, 所有认证因素通过后检查密码是否过期, 过期返回 ErrorPasswordExpired
+func (mgr *UserMgr) loginWithMFA(user *User, from string, isCheckPasswordExpired bool, metas ...*tokenmgr.SessionMeta) (token string, deadline int64, err error) {
+	if mgr.config.IsEnableMFA {
+		var enabled bool
+		if enabled, err = user.IsMFAEnabled(); err != nil {
+			return
+		}
+		if enabled {
+			var challenge *MFAChallenge
+			if challenge, err = mgr.newMFAChallenge(&mfaChallengeValue{
+				UID:                    user.UID,
+				From:                   from,
+				Meta:                   tokenmgr.GetMeta(metas...),
+				IsCheckPasswordExpired: isCheckPasswordExpired,
+			}); err != nil {
+				return
+			}
+			err = challenge
+			return
+		}
+	}
+	if isCheckPasswordExpired {
+		if err = mgr.checkPasswordExpired(user.ID); err != nil {
+			return
+		}
+	}
+	return user.LoginWithFrom(from, metas...)
+}
+
+func (mgr *UserMgr) newMFAChallenge(value *mfaChallengeValue) (*MFAChallenge, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := mgr.pool.Get()
+	defer conn.Close()
+
+	challengeID := uuidplus.NewV4().Base62()
+	challengeKey := getMFAChallengeKey(mgr.name, challengeID)
+	if err = conn.Send("HMSET", challengeKey, "value", string(data), "fails", 0); err != nil {
+		return nil, err
+	}
+	if err = conn.Send("EXPIRE", challengeKey, mgr.config.MFAChallengeExpire); err != nil {
+		return nil, err
+	}
+	if err = conn.Flush(); err != nil {
+		return nil, err
+	}
+	for i := 0; i < 2; i++ {
+		if _, err = conn.Receive(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &MFAChallenge{
+		ID:     challengeID,
+		Expire: mgr.config.MFAChallengeExpire,
+	}, nil
+}
+
+// completeMFA 完成二次验证 verify 校验第二因素
+// 挑战只能成功使用一次; 失败次数达到 CodeMaxAttempts 后挑战失效, 返回 ErrorTooManyAttempts
+// 每次失败同时计入用户uid和IP的登录失败次数, 重新发起挑战也不能绕过锁定
+func (mgr *UserMgr) completeMFA(challengeID string, verify func(user *User) (bool, error)) (user *User, token string, deadline int64, err error) {
+	conn := mgr.pool.Get()
+	defer conn.Close()
+
+	challengeKey := getMFAChallengeKey(mgr.name, challengeID)
+	var data string
+	if data, err = redigo.String(conn.Do("HGET", challengeKey, "value")); err == redigo.ErrNil {
+		err = ErrorMFAInvalid
+		return
+	} else if err != nil {
+		return
+	}
+
+	value := &mfaChallengeValue{}
+	if err = json.Unmarshal([]byte(data), value); err != nil {
+		return
+	}
+
+	ip := tokenmgr.GetMeta(value.Meta).IP
+	if err = mgr.checkLocked(value.UID, ip); err != nil {
+		return
+	}
+
+	var ok bool
+	if ok, user, err = mgr.FindUserByUID(value.UID); err != nil {
+		return
+	} else if !ok {
+		if _, errDel := conn.Do("DEL", challengeKey); errDel != nil {
+			mlogger.WarnN(mgr.mlogname, "completeMFA DEL %v err: %v", challengeID, errDel)
+		}
+		return nil, "", 0, ErrorNotFound
+	}
+
+	if ok, err = verify(user); err != nil {
+		return nil, "", 0, err
+	} else if !ok {
+		var left int
+		if left, err = redigo.Int(failMFAChallengeScript.Do(conn, challengeKey, mgr.config.CodeMaxAttempts)); err != nil {
+			return nil, "", 0, err
+		}
+		switch {
+		case left < 0:
+			err = ErrorMFAInvalid
+		case left == 0:
+			err = ErrorTooManyAttempts
+		default:
+			err = ErrorMFACodeWrong
+		}
+		return nil, "", 0, mgr.loginFailed(value.UID, ip, err)
+	}
+
+	// 并发完成时只有一个成功
+	var n int
+	if n, err = redigo.Int(conn.Do("DEL", challengeKey)); err != nil {
+		return nil, "", 0, err
+	} else if n == 0 {
+		return nil, "", 0, ErrorMFAInvalid
+	}
+	mgr.onLoginSucceeded(value.UID)
+
+	if value.IsCheckPasswordExpired {
+		if err = mgr.checkPasswordExpired(user.ID); err == ErrorPasswordExpired {
+			return user, "", 0, err
+		} else if err != nil {
+			return nil, "", 0, err
+		}
+	}
+
+	if token, deadline, err = user.LoginWithFrom(value.From, value.Meta); err != nil {
+		return nil, "", 0, err
+	}
+	return
+}
+
+// CompleteMFA 使用TOTP验证码完成二次验证并登录
+// 挑战来自密码登录且密码已过期时不返回token, 返回 user 和 ErrorPasswordExpired
+func (mgr *UserMgr) CompleteMFA(challengeID, code string) (user *User, token string, deadline int64, err error) {
+	return mgr.completeMFA(challengeID, func(user *User) (bool, error) {
+		return user.verifyTOTP(code)
+	})
+}
+
+// getMFA 获取多因素认证记录 不存在返回 ErrorNotFound
+func (user *User) getMFA(mfaType string) (*ModelUserMFA, error) {
+	query := fmt.Sprintf("SELECT * FROM %v WHERE uid = ? AND mfa_type = ?;", user.mgr.tableUserMFA.Name)
+	args := []interface{}{user.UID, mfaType}
+
+	rows, err := user.mgr.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := &ModelUserMFA{}
+	if err = sqlplus.Get(rows, result); err == sql.ErrNoRows {
+		return nil, ErrorNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// checkTOTP 校验TOTP验证码 同一时间步的验证码只能使用一次
+func (user *User) checkTOTP(secret, code string) (bool, error) {
+	ok, step, err := totp.Verify(secret, code, time.Now(), totpSkew)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	conn := user.mgr.pool.Get()
+	defer conn.Close()
+
+	result, err := redigo.String(conn.Do("SET", getTOTPUsedKey(user.mgr.name, user.UID, step), "1",
+		"EX", totp.Period*(2*totpSkew+2), "NX"))
+	if err == redigo.ErrNil {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return result == "OK", nil
+}
+
+// verifyTOTP 使用已启用的TOTP校验
+func (user *User) verifyTOTP(code string) (bool, error) {
+	data, err := user.getMFA(MFATypeTOTP)
+	if err == ErrorNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if data.Enabled == 0 {
+		return false, nil
+	}
+	secret, err := user.openTOTPSecret(data)
+	if err != nil {
+		return false, err
+	}
+	return user.checkTOTP(secret, code)
+}
+
+// openTOTPSecret 解密TOTP密钥 未加密的旧数据原样返回
+func (user *User) openTOTPSecret(data *ModelUserMFA) (string, error) {
+	secret, _, err := user.mgr.open(sealLabelTOTP, user.UID, data.Secret)
+	return secret, err
+}
+
+// IsMFAEnabled 是否启用了多因素认证
+func (user *User) IsMFAEnabled() (bool, error) {
+	if !user.mgr.config.IsEnableMFA {
+		return false, nil
+	}
+	data, err := user.getMFA(MFATypeTOTP)
+	if err == ErrorNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return data.Enabled == 1, nil
+}
+
+// EnrollTOTP 开始绑定TOTP 返回密钥和 otpauth URI(用于生成二维码), 需 ConfirmTOTP 后生效
+// 未确认前重复调用会重新生成密钥
+func (user *User) EnrollTOTP() (secret, uri string, err error) {
+	if !user.mgr.config.IsEnableMFA {
+		return "", "", fmt.Errorf("IsEnableMFA is not enable")
+	}
+
+	var data *ModelUserMFA
+	if data, err = user.getMFA(MFATypeTOTP); err != nil && err != ErrorNotFound {
+		return
+	}
+	if data != nil && data.Enabled == 1 {
+		return "", "", ErrorMFAEnabled
+	}
+
+	if secret, err = totp.GenerateSecret(); err != nil {
+		return
+	}
+	// 密钥加密存储 与用户uid绑定
+	var sealed string
+	if sealed, err = user.mgr.seal(sealLabelTOTP, user.UID, secret); err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+	if data == nil {
+		data = &ModelUserMFA{
+			UID:     user.UID,
+			MFAType: MFATypeTOTP,
+			Secret:  sealed,
+			Created: now,
+			Updated: now,
+		}
+		query, args := sqlplus.GenInsert(user.mgr.tableUserMFA.Name, data)
+		if _, err = sqlplus.LastInsertId(user.mgr.db.Exec(query, args...)); err != nil {
+			return "", "", err
+		}
+	} else {
+		query := fmt.Sprintf("UPDATE %v Set secret = ?, updated = ? WHERE id = ? AND enabled = 0;", user.mgr.tableUserMFA.Name)
+		args := []interface{}{sealed, now, data.ID}
+		var n int
+		if n, err = sqlplus.RowsAffected(user.mgr.db.Exec(query, args...)); err != nil {
+			return "", "", err
+		} else if n == 0 {
+			return "", "", ErrorMFAEnabled
+		}
+	}
+
+	account := user.UID
+	if user.Email != "" {
+		account = user.Email
+	} else if user.Mobile != "" {
+		account = user.Mobile
+	}
+	uri = totp.URI(user.mgr.config.MFAIssuer, account, secret)
+	return
+}
+
+// ConfirmTOTP 使用验证器App生成的第一个验证码确认绑定 确认后登录需要二次验证
+func (user *User) ConfirmTOTP(code string) error {
+	data, err := user.getMFA(MFATypeTOTP)
+	if err != nil {
+		return err
+	}
+	if data.Enabled == 1 {
+		return ErrorMFAEnabled
+	}
+
+	secret, err := user.openTOTPSecret(data)
+	if err != nil {
+		return err
+	}
+	ok, err := user.checkTOTP(secret, code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrorMFACodeWrong
+	}
+
+	query := fmt.Sprintf("UPDATE %v Set enabled = 1, updated = ? WHERE id = ? AND secret = ?;", user.mgr.tableUserMFA.Name)
+	args := []interface{}{time.Now(), data.ID, data.Secret}
+	n, err := sqlplus.RowsAffected(user.mgr.db.Exec(query, args...))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrorNotFound
+	}
+	return nil
+}
+
+// DisableTOTP 解绑TOTP 需要当前有效的验证码 恢复码同时失效
+func (user *User) DisableTOTP(code string) error {
+	data, err := user.getMFA(MFATypeTOTP)
+	if err != nil {
+		return err
+	}
+
+	if data.Enabled == 1 {
+		secret, err := user.openTOTPSecret(data)
+		if err != nil {
+			return err
+		}
+		ok, err := user.checkTOTP(secret, code)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrorMFACodeWrong
+		}
+	}
+
+	query := fmt.Sprintf("DELETE FROM %v WHERE id = ?;", user.mgr.tableUserMFA.Name)
+	args := []interface{}{data.ID}
+	if _, err = sqlplus.RowsAffected(user.mgr.db.Exec(query, args...)); err != nil {
+		return err
+	}
+
+	// 恢复码随之失效
+	queryRecoveryCode := fmt.Sprintf("DELETE FROM %v WHERE uid = ?;", user.mgr.tableRecoveryCode.Name)
+	argsRecoveryCode := []interface{}{user.UID}
+	if _, errDel := user.mgr.db.Exec(queryRecoveryCode, argsRecoveryCode...); errDel != nil {
+		mlogger.WarnN(user.mgr.mlogname, "DisableTOTP delete recovery codes %v err: %v", user.UID, errDel)
+	}
+	return nil
+}
+
+// MigrateTOTPSecrets 把未加密或使用旧主密钥加密的TOTP密钥, 用当前主密钥重新加密 返回迁移的数量
+// 用于升级后加密已有数据和轮换主密钥, 可重复执行
+func (mgr *UserMgr) MigrateTOTPSecrets() (int, error) {
+	query := fmt.Sprintf("SELECT id, uid, secret FROM %v WHERE mfa_type = ?;", mgr.tableUserMFA.Name)
+	rows, err := mgr.db.Query(query, MFATypeTOTP)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	result := []*ModelUserMFA{}
+	for rows.Next() {
+		data := &ModelUserMFA{}
+		if err = rows.Scan(&data.ID, &data.UID, &data.Secret); err != nil {
+			return 0, err
+		}
+		result = append(result, data)
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, data := range result {
+		secret, isCurrent, err := mgr.open(sealLabelTOTP, data.UID, data.Secret)
+		if err != nil {
+			return count, err
+		}
+		if isCurrent {
+			continue
+		}
+
+		sealed, err := mgr.seal(sealLabelTOTP, data.UID, secret)
+		if err != nil {
+			return count, err
+		}
+		// 只更新未被修改过的数据
+		queryUpdate := fmt.Sprintf("UPDATE %v SET secret = ? WHERE id = ? AND secret = ?;", mgr.tableUserMFA.Name)
+		argsUpdate := []interface{}{sealed, data.ID, data.Secret}
+		n, err := sqlplus.RowsAffected(mgr.db.Exec(queryUpdate, argsUpdate...))
+		if err != nil {
+			return count, err
+		}
+		count += n
+	}
+	return count, nil
+}
@@ -1,17 +1,30 @@
 package gouser
 
 import (
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/hex"
 	"fmt"
+	"net"
+	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/cheetah-fun-gs/goplus/cacher"
+	sqlplus "github.com/cheetah-fun-gs/goplus/dao/sql"
 	randplus "github.com/cheetah-fun-gs/goplus/math/rand"
+	mlogger "github.com/cheetah-fun-gs/goplus/multier/multilogger"
 	uuidplus "github.com/cheetah-fun-gs/goplus/uuid"
 	"github.com/cheetah-fun-gs/gouser/authmgr"
+	"github.com/cheetah-fun-gs/gouser/codesender"
+	"github.com/cheetah-fun-gs/gouser/keyprovider"
+	"github.com/cheetah-fun-gs/gouser/passwordhasher"
+	"github.com/cheetah-fun-gs/gouser/signer"
 	"github.com/cheetah-fun-gs/gouser/tokenmgr"
+	"github.com/cheetah-fun-gs/gouser/webauthn"
 	redigo "github.com/gomodule/redigo/redis"
 )
 
@@ -27,14 +40,25 @@ type modelTable struct {
 // UserMgr 用户管理器
 type UserMgr struct {
 	tokenmgr           tokenmgr.TokenMgr                               // token 管理器
+	refreshmgr         *tokenmgr.RefreshMgr                            // 刷新令牌管理器
+	passwordHasher     passwordhasher.PasswordHasher                   // 密码哈希
+	passwordPolicy     *PasswordPolicy                                 // 密码强度策略
 	tableUser          *modelTable                                     // 用户表
 	tableUserAuth      *modelTable                                     // 第三方认证表
+	tablePasswordHist  *modelTable                                     // 历史密码表
 	tableUserAccessKey *modelTable                                     // 访问密钥表
+	tableUserMFA       *modelTable                                     // 多因素认证表
+	tableRecoveryCode  *modelTable                                     // 恢复码表
+	tableUserWebAuthn  *modelTable                                     // WebAuthn凭证表
+	keyProvider        keyprovider.Provider                            // 主密钥提供者 用于加密访问密钥和TOTP密钥
+	webauthnMgr        *webauthn.RelyingPartyMgr                       // WebAuthn 依赖方
 	generateUID        func() (uid, nickname, avatar, extra string)    // 生成一个全新的uid和扩展信息
 	generateCode       func() string                                   // 生成一个校验码
 	generateAccessKey  func() string                                   // 生成一个全新的AccessKey
 	generateSign       func(accessKey string, data interface{}) string // AccessKey校验算法
 	authMgrs           []authmgr.AuthMgr                               // 支持的第三方认证方式
+	codeSenders        map[string]codesender.CodeSender                // 验证码发送器 按渠道区分
+	codeTemplates      map[string]map[string]*codesender.Template      // 验证码消息模板 模板名称:locale:模板
 	accessKeyCacher    *cacher.Cacher                                  // access key 缓存
 	userDataUIDCacher  *cacher.Cacher                                  // modelUser 对 uid 缓存
 	pool               *redigo.Pool
@@ -47,10 +71,38 @@ type UserMgr struct {
 
 // Config ...
 type Config struct {
-	TokenExpire       int  // token 超时时间
-	CodeExpire        int  // 验证码过期时间
-	CodeRetry         int  // 验证码重试间隔
-	IsEnableAccessKey bool // 是否支持访问密钥
+	TokenExpire                 int                          // token 超时时间
+	RefreshTokenExpire          int                          // 刷新令牌超时时间 从登录时开始计算, 轮换不延长
+	TokenPolicies               map[string]*tokenmgr.Policy  // 按来源的并发会话策略 仅对默认token管理器生效
+	TokenSlideInterval          int                          // token滑动续期的最小间隔 为0不启用 仅对默认token管理器生效
+	TokenMaxLifetime            int                          // token滑动续期的最长有效期 默认7天
+	PasswordPolicy              *PasswordPolicy              // 密码强度策略 为nil不校验
+	PasswordHistory             int                          // 修改密码时不允许重复使用最近N次的密码 为0不限制
+	PasswordMaxAge              int                          // 密码最长有效期 秒 过期后密码登录返回 ErrorPasswordExpired 为0不限制
+	CodeExpire                  int                          // 验证码过期时间
+	CodeRetry                   int                          // 验证码重试间隔
+	CodeMaxAttempts             int                          // 验证码同一场景最大失败次数 超过后当前验证码失效, 重新申请后重新计数
+	CodeSettings                map[CodePurpose]*CodeSetting // 按用途的验证码配置 过期时间、长度、字母表
+	CodeLimitTarget             []*RateLimit                 // 同一目标(手机号/邮箱/用户)申请验证码的限流 可配置多个窗口
+	CodeLimitIP                 []*RateLimit                 // 同一IP申请验证码的限流
+	CodeLimitDevice             []*RateLimit                 // 同一设备申请验证码的限流
+	CodeLimitGlobal             []*RateLimit                 // 全局申请验证码的限流 如每小时、每天上限
+	LockThreshold               int                          // 同一账号连续登录失败N次后锁定 为0不启用
+	LockIPThreshold             int                          // 同一IP连续登录失败N次后锁定 为0不启用
+	LockDuration                int                          // 首次锁定时长 之后每次锁定翻倍 默认60秒
+	LockMaxDuration             int                          // 最长锁定时长 默认1天
+	LockWindow                  int                          // 失败次数和锁定次数的保留时间 默认1小时
+	IsEnableAccessKey           bool                         // 是否支持访问密钥
+	SignSkew                    int                          // 请求签名时间允许的误差 默认300秒
+	SignMaxBodySize             int64                        // 校验请求签名时请求体的最大字节数 默认10MB, 小于0不限制
+	IsEnableMFA                 bool                         // 是否支持多因素认证
+	MFAIssuer                   string                       // TOTP 签发方 显示在验证器App中 默认为name
+	MFAChallengeExpire          int                          // 二次验证挑战过期时间
+	MFARecoveryCodes            int                          // 每次生成的恢复码数量
+	WebAuthn                    *webauthn.Config             // WebAuthn 依赖方配置 为nil时不支持
+	IsDisableLAPDAutoRegister   bool                         // 密码登录时用户不存在是否禁止自动注册
+	IsDisableEmailAutoRegister  bool                         // 邮箱登录时用户不存在是否禁止自动注册
+	IsDisableMobileAutoRegister bool                         // 手机登录时用户不存在是否禁止自动注册
 }
 
 func defaultGenerateUID() (uid, nickname, avatar, extra string) {
@@ -70,6 +122,13 @@ func defaultGenerateSign(accessKey string, data interface{}) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
+// defaultKeyProvider 默认主密钥 以独立的标签由 secret 派生, 与验证码等使用 secret 的HMAC互不相同
+func defaultKeyProvider(secret string) keyprovider.Provider {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte("gouser:master_key"))
+	return keyprovider.NewStaticProvider("default", map[string][]byte{"default": h.Sum(nil)})
+}
+
 func defaultGenerateCode() string {
 	return fmt.Sprintf("%03d", randplus.MustRandint(0, 999999))
 }
@@ -85,25 +144,73 @@ func New(name, secret string, pool *redigo.Pool, db *sql.DB, configs ...Config)
 	if config.TokenExpire == 0 {
 		config.TokenExpire = 3600 * 2
 	}
+	if config.RefreshTokenExpire == 0 {
+		config.RefreshTokenExpire = 3600 * 24 * 30
+	}
+	if config.TokenSlideInterval > 0 && config.TokenMaxLifetime == 0 {
+		config.TokenMaxLifetime = 3600 * 24 * 7
+	}
 	if config.CodeExpire == 0 {
 		config.CodeExpire = 600
 	}
 	if config.CodeRetry == 0 {
 		config.CodeRetry = 60
 	}
+	if config.CodeMaxAttempts == 0 {
+		config.CodeMaxAttempts = 5
+	}
+	if config.SignSkew == 0 {
+		config.SignSkew = 300
+	}
+	if config.SignMaxBodySize == 0 {
+		config.SignMaxBodySize = signer.DefaultMaxBodySize
+	}
+	if config.LockDuration == 0 {
+		config.LockDuration = 60
+	}
+	if config.LockMaxDuration == 0 {
+		config.LockMaxDuration = 3600 * 24
+	}
+	if config.LockWindow == 0 {
+		config.LockWindow = 3600
+	}
+	if config.MFAIssuer == "" {
+		config.MFAIssuer = name
+	}
+	if config.MFAChallengeExpire == 0 {
+		config.MFAChallengeExpire = 300
+	}
+	if config.MFARecoveryCodes == 0 {
+		config.MFARecoveryCodes = 10
+	}
+
+	tokenMgr := tokenmgr.New(name, pool, config.TokenExpire)
+	for from, policy := range config.TokenPolicies {
+		tokenMgr.SetPolicy(from, policy)
+	}
+	if config.TokenSlideInterval > 0 {
+		tokenMgr.SetSliding(config.TokenSlideInterval, config.TokenMaxLifetime)
+	}
 
 	tableUserName := name + "_user"
 	tableUserAuthName := name + "_user_auth"
 	tableUserAccessKeyName := name + "_user_access_key"
+	tablePasswordHistName := name + "_user_password_history"
+	tableUserMFAName := name + "_user_mfa"
+	tableRecoveryCodeName := name + "_user_recovery_code"
+	tableUserWebAuthnName := name + "_user_webauthn"
 
 	mgr := &UserMgr{
-		name:     name,
-		secret:   secret,
-		mlogname: "default",
-		config:   config,
-		pool:     pool,
-		db:       db,
-		tokenmgr: tokenmgr.New(name, pool, config.TokenExpire),
+		name:           name,
+		secret:         secret,
+		mlogname:       "default",
+		config:         config,
+		pool:           pool,
+		db:             db,
+		tokenmgr:       tokenMgr,
+		refreshmgr:     tokenmgr.NewRefreshMgr(name, pool, config.RefreshTokenExpire),
+		passwordHasher: passwordhasher.NewArgon2id(),
+		passwordPolicy: config.PasswordPolicy,
 		tableUser: &modelTable{
 			Name:      tableUserName,
 			CreateSQL: fmt.Sprintf(TableUser, tableUserName),
@@ -112,14 +219,33 @@ func New(name, secret string, pool *redigo.Pool, db *sql.DB, configs ...Config)
 			Name:      tableUserAuthName,
 			CreateSQL: fmt.Sprintf(TableUserAuth, tableUserAuthName),
 		},
+		tablePasswordHist: &modelTable{
+			Name:      tablePasswordHistName,
+			CreateSQL: fmt.Sprintf(TableUserPasswordHistory, tablePasswordHistName),
+		},
 		tableUserAccessKey: &modelTable{
 			Name:      tableUserAccessKeyName,
 			CreateSQL: fmt.Sprintf(TableUserAccessKey, tableUserAccessKeyName),
 		},
+		tableUserMFA: &modelTable{
+			Name:      tableUserMFAName,
+			CreateSQL: fmt.Sprintf(TableUserMFA, tableUserMFAName),
+		},
+		tableRecoveryCode: &modelTable{
+			Name:      tableRecoveryCodeName,
+			CreateSQL: fmt.Sprintf(TableUserRecoveryCode, tableRecoveryCodeName),
+		},
+		tableUserWebAuthn: &modelTable{
+			Name:      tableUserWebAuthnName,
+			CreateSQL: fmt.Sprintf(TableUserWebAuthn, tableUserWebAuthnName),
+		},
 		generateUID:       defaultGenerateUID,
 		generateAccessKey: defaultGenerateAccessKey,
 		generateSign:      defaultGenerateSign,
 		generateCode:      defaultGenerateCode,
+		codeSenders:       map[string]codesender.CodeSender{},
+		codeTemplates:     defaultCodeTemplates(),
+		keyProvider:       defaultKeyProvider(secret),
 		userDataUIDCacher: cacher.New(tableUserName, pool, &userDataUIDCacher{
 			db: db,
 			tableUser: &modelTable{
@@ -127,6 +253,9 @@ func New(name, secret string, pool *redigo.Pool, db *sql.DB, configs ...Config)
 				CreateSQL: fmt.Sprintf(TableUser, tableUserName),
 			}}),
 	}
+	if config.WebAuthn != nil {
+		mgr.webauthnMgr = webauthn.New(config.WebAuthn)
+	}
 	if config.IsEnableAccessKey {
 		mgr.accessKeyCacher = cacher.New(tableUserAccessKeyName, pool, &accessKeyCacher{
 			db: db,
@@ -154,6 +283,11 @@ func (mgr *UserMgr) SetTokenMgr(arg tokenmgr.TokenMgr) {
 	mgr.tokenmgr = arg
 }
 
+// SetPasswordHasher 设置密码哈希 旧哈希的密码在下次登录成功时自动升级
+func (mgr *UserMgr) SetPasswordHasher(arg passwordhasher.PasswordHasher) {
+	mgr.passwordHasher = arg
+}
+
 // SetGenerateUID 设置生成用户信息的方法 如果uid格式改变，可能需要修改sql表结构
 func (mgr *UserMgr) SetGenerateUID(arg func() (uid, nickname, avatar, extra string)) {
 	mgr.generateUID = arg
@@ -174,6 +308,13 @@ func (mgr *UserMgr) SetGenerateSign(arg func(accessKey string, data interface{})
 	mgr.generateSign = arg
 }
 
+// SetKeyProvider 设置主密钥提供者 用于加密访问密钥和TOTP密钥, 默认由 secret 以独立的标签派生
+// 建议使用与 secret 无关的主密钥, 泄露 secret 不会同时泄露加密的数据
+// 更换后需调用 MigrateAccessKeys 和 MigrateTOTPSecrets 重新加密, 旧主密钥在迁移完成前需保留在新的提供者中
+func (mgr *UserMgr) SetKeyProvider(provider keyprovider.Provider) {
+	mgr.keyProvider = provider
+}
+
 // SetTableUser 设置用户表表名和表结构
 func (mgr *UserMgr) SetTableUser(tableName, tableCreateSQL string) error {
 	mgr.tableUser = &modelTable{
@@ -192,6 +333,15 @@ func (mgr *UserMgr) SetTableAuth(tableName, tableCreateSQL string) error {
 	return nil
 }
 
+// SetTablePasswordHistory 设置历史密码表表名和表结构
+func (mgr *UserMgr) SetTablePasswordHistory(tableName, tableCreateSQL string) error {
+	mgr.tablePasswordHist = &modelTable{
+		Name:      tableName,
+		CreateSQL: tableCreateSQL,
+	}
+	return nil
+}
+
 // SetTableAccessKey 设置accessKey表表名和表结构
 func (mgr *UserMgr) SetTableAccessKey(tableName, tableCreateSQL string) error {
 	mgr.tableUserAccessKey = &modelTable{
@@ -201,6 +351,33 @@ func (mgr *UserMgr) SetTableAccessKey(tableName, tableCreateSQL string) error {
 	return nil
 }
 
+// SetTableMFA 设置多因素认证表表名和表结构
+func (mgr *UserMgr) SetTableMFA(tableName, tableCreateSQL string) error {
+	mgr.tableUserMFA = &modelTable{
+		Name:      tableName,
+		CreateSQL: tableCreateSQL,
+	}
+	return nil
+}
+
+// SetTableRecoveryCode 设置恢复码表表名和表结构
+func (mgr *UserMgr) SetTableRecoveryCode(tableName, tableCreateSQL string) error {
+	mgr.tableRecoveryCode = &modelTable{
+		Name:      tableName,
+		CreateSQL: tableCreateSQL,
+	}
+	return nil
+}
+
+// SetTableWebAuthn 设置WebAuthn凭证表表名和表结构
+func (mgr *UserMgr) SetTableWebAuthn(tableName, tableCreateSQL string) error {
+	mgr.tableUserWebAuthn = &modelTable{
+		Name:      tableName,
+		CreateSQL: tableCreateSQL,
+	}
+	return nil
+}
+
 // EnsureTables 确保sql表已建立
 func (mgr *UserMgr) EnsureTables() error {
 	for _, createSQL := range mgr.TablesCreateSQL() {
@@ -217,9 +394,18 @@ func (mgr *UserMgr) TablesCreateSQL() []string {
 	if len(mgr.authMgrs) > 0 {
 		result = append(result, mgr.tableUserAuth.CreateSQL)
 	}
+	if mgr.config.PasswordHistory > 0 {
+		result = append(result, mgr.tablePasswordHist.CreateSQL)
+	}
 	if mgr.config.IsEnableAccessKey {
 		result = append(result, mgr.tableUserAccessKey.CreateSQL)
 	}
+	if mgr.config.IsEnableMFA {
+		result = append(result, mgr.tableUserMFA.CreateSQL, mgr.tableRecoveryCode.CreateSQL)
+	}
+	if mgr.config.WebAuthn != nil {
+		result = append(result, mgr.tableUserWebAuthn.CreateSQL)
+	}
 	return result
 }
 
@@ -229,16 +415,87 @@ func (mgr *UserMgr) TablesName() []string {
 	if len(mgr.authMgrs) > 0 {
 		result = append(result, mgr.tableUserAuth.Name)
 	}
+	if mgr.config.PasswordHistory > 0 {
+		result = append(result, mgr.tablePasswordHist.Name)
+	}
 	if mgr.config.IsEnableAccessKey {
 		result = append(result, mgr.tableUserAccessKey.Name)
 	}
+	if mgr.config.IsEnableMFA {
+		result = append(result, mgr.tableUserMFA.Name, mgr.tableRecoveryCode.Name)
+	}
+	if mgr.config.WebAuthn != nil {
+		result = append(result, mgr.tableUserWebAuthn.Name)
+	}
 	return result
 }
 
-func (mgr *UserMgr) getPassword(rawPassword string) string {
+// getLegacyPassword 旧版密码算法 仅用于校验和升级存量密码
+func (mgr *UserMgr) getLegacyPassword(rawPassword string) string {
 	return uuidplus.NewV5(mgr.secret, rawPassword).Base62()
 }
 
+func (mgr *UserMgr) getPassword(rawPassword string) (string, error) {
+	return mgr.passwordHasher.Hash(rawPassword)
+}
+
+// checkPassword 校验用户密码 未设置密码的用户(如邮箱、手机注册)始终不通过
+// 校验通过后, 旧算法或旧参数生成的密码自动按当前算法升级
+func (mgr *UserMgr) checkPassword(id int, rawPassword string) error {
+	query := fmt.Sprintf("SELECT password FROM %v WHERE id = ?;", mgr.tableUser.Name)
+	args := []interface{}{id}
+
+	var password string
+	if err := mgr.db.QueryRow(query, args...).Scan(&password); err == sql.ErrNoRows {
+		return ErrorNotFound
+	} else if err != nil {
+		return err
+	}
+
+	ok, needRehash, err := mgr.matchPassword(password, rawPassword)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrorPasswordWrong
+	}
+
+	if needRehash {
+		if err := mgr.rehashPassword(id, password, rawPassword); err != nil {
+			mlogger.WarnN(mgr.mlogname, "rehashPassword %v err: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// matchPassword 比较密码和已保存的哈希 兼容旧算法
+func (mgr *UserMgr) matchPassword(password, rawPassword string) (ok, needRehash bool, err error) {
+	if password == "" {
+		return false, false, nil
+	}
+
+	if passwordhasher.IsHashed(password) {
+		if ok, err = mgr.passwordHasher.Verify(rawPassword, password); err != nil || !ok {
+			return false, false, err
+		}
+		return true, mgr.passwordHasher.NeedRehash(password), nil
+	}
+	return subtle.ConstantTimeCompare([]byte(password), []byte(mgr.getLegacyPassword(rawPassword))) == 1, true, nil
+}
+
+// rehashPassword 升级密码哈希 仅在密码未被并发修改时生效
+func (mgr *UserMgr) rehashPassword(id int, oldPassword, rawPassword string) error {
+	password, err := mgr.getPassword(rawPassword)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("UPDATE %v Set password = ? WHERE id = ? AND password = ?;", mgr.tableUser.Name)
+	args := []interface{}{password, id, oldPassword}
+	_, err = sqlplus.RowsAffected(mgr.db.Exec(query, args...))
+	return err
+}
+
 // VerifyToken 验证token
 func (mgr *UserMgr) VerifyToken(uid, token string) (ok bool, err error) {
 	return mgr.VerifyTokenWithFrom(uid, fromDefault, token)
@@ -249,19 +506,154 @@ func (mgr *UserMgr) VerifyTokenWithFrom(uid, from, token string) (ok bool, err e
 	return mgr.tokenmgr.Verify(uid, from, token)
 }
 
+// RefreshToken 使用刷新令牌换取新的token 刷新令牌同时轮换, 旧刷新令牌作废
+// 已作废的刷新令牌再次使用时, 同一次登录产生的所有刷新令牌全部作废, 用它们换取的会话一并注销, 返回 tokenmgr.ErrorRefreshTokenReused
+func (mgr *UserMgr) RefreshToken(refreshToken string, metas ...*tokenmgr.SessionMeta) (user *User, token string, deadline int64, newRefreshToken string, refreshDeadline int64, err error) {
+	var uid, from string
+	uid, from, newRefreshToken, refreshDeadline, err = mgr.refreshmgr.Rotate(refreshToken)
+	if reused, ok := err.(*tokenmgr.RefreshReusedError); ok {
+		for _, sessionID := range reused.SessionIDs {
+			if errRevoke := mgr.tokenmgr.Revoke(reused.UID, sessionID); errRevoke != nil {
+				mlogger.WarnN(mgr.mlogname, "RefreshToken Revoke %v %v err: %v", reused.UID, sessionID, errRevoke)
+			}
+		}
+		return nil, "", 0, "", 0, tokenmgr.ErrorRefreshTokenReused
+	} else if err != nil {
+		return
+	}
+
+	var ok bool
+	ok, user, err = mgr.FindUserByUID(uid)
+	if err != nil {
+		return nil, "", 0, "", 0, err
+	}
+	if !ok {
+		if errRevoke := mgr.refreshmgr.Revoke(newRefreshToken); errRevoke != nil {
+			mlogger.WarnN(mgr.mlogname, "RefreshToken Revoke %v err: %v", uid, errRevoke)
+		}
+		return nil, "", 0, "", 0, ErrorNotFound
+	}
+
+	if token, deadline, err = mgr.tokenmgr.Generate(uid, from, metas...); err != nil {
+		return nil, "", 0, "", 0, err
+	}
+	if err = mgr.refreshmgr.Bind(newRefreshToken, mgr.tokenmgr.SessionID(from, token)); err != nil {
+		return nil, "", 0, "", 0, err
+	}
+	return
+}
+
+// RevokeRefreshToken 作废刷新令牌 同一次登录产生的所有刷新令牌全部作废
+func (mgr *UserMgr) RevokeRefreshToken(refreshToken string) error {
+	return mgr.refreshmgr.Revoke(refreshToken)
+}
+
 // VerifySign 验证sign: sign由access key和请求数据(或请求数据部分字段)计算得到
-func (mgr *UserMgr) VerifySign(uid string, accessKeyID int, data interface{}, sign string) (ok bool, err error) {
+// 通过时返回密钥的权限范围 为空表示拥有用户的全部权限, 并记录使用时间和IP(取自 metas)
+func (mgr *UserMgr) VerifySign(uid string, accessKeyID int, data interface{}, sign string, metas ...*tokenmgr.SessionMeta) (ok bool, scopes Scopes, err error) {
 	if !mgr.config.IsEnableAccessKey {
-		return false, fmt.Errorf("IsEnableAccessKey is not enable")
+		return false, nil, fmt.Errorf("IsEnableAccessKey is not enable")
 	}
-	var accessKey string
-	if ok, err := mgr.accessKeyCacher.Get(&accessKey, uid, accessKeyID); err != nil {
-		return false, err
+	var accessKey *ModelUserAccessKey
+	if ok, accessKey, err = mgr.getAccessKey(uid, accessKeyID); err != nil {
+		return false, nil, err
 	} else if !ok {
-		return false, fmt.Errorf("accessKey not found")
+		return false, nil, fmt.Errorf("accessKey not found")
 	}
 
-	return sign == mgr.generateSign(accessKey, data), nil
+	if !hmac.Equal([]byte(sign), []byte(mgr.generateSign(accessKey.AccessKey, data))) {
+		return false, nil, nil
+	}
+	mgr.recordAccessKeyUsage(accessKey.ID, tokenmgr.GetMeta(metas...).IP)
+	return true, parseScopes(accessKey.Scopes), nil
+}
+
+// VerifySignByKeyID 按公开的密钥ID验证sign, 通过时返回密钥所属的用户和密钥的权限范围, 并记录使用时间和IP(取自 metas)
+func (mgr *UserMgr) VerifySignByKeyID(keyID string, data interface{}, sign string, metas ...*tokenmgr.SessionMeta) (ok bool, user *User, scopes Scopes, err error) {
+	if !mgr.config.IsEnableAccessKey {
+		return false, nil, nil, fmt.Errorf("IsEnableAccessKey is not enable")
+	}
+	var accessKey *ModelUserAccessKey
+	if ok, accessKey, err = mgr.getAccessKeyByKeyID(keyID); err != nil {
+		return
+	} else if !ok {
+		return false, nil, nil, fmt.Errorf("accessKey not found")
+	}
+
+	if !hmac.Equal([]byte(sign), []byte(mgr.generateSign(accessKey.AccessKey, data))) {
+		return false, nil, nil, nil
+	}
+	mgr.recordAccessKeyUsage(accessKey.ID, tokenmgr.GetMeta(metas...).IP)
+	if ok, user, err = mgr.FindUserByUID(accessKey.UID); err != nil || !ok {
+		return
+	}
+	return true, user, parseScopes(accessKey.Scopes), nil
+}
+
+// VerifyRequestSign 验证 signer 签名的请求 Credential 为公开的密钥ID, 兼容 uid/accessKeyID
+// 通过时返回密钥所属的用户和密钥的权限范围, 并记录使用时间和IP(取自 metas, 默认为 RemoteAddr); 签名时间与服务器时间误差超过 SignSkew 返回 signer.ErrorSignExpired, 随机数重复使用返回 signer.ErrorSignReplayed
+// 请求体超过 SignMaxBodySize 返回 signer.ErrorBodyTooLarge
+func (mgr *UserMgr) VerifyRequestSign(r *http.Request, metas ...*tokenmgr.SessionMeta) (ok bool, user *User, scopes Scopes, err error) {
+	if !mgr.config.IsEnableAccessKey {
+		return false, nil, nil, fmt.Errorf("IsEnableAccessKey is not enable")
+	}
+
+	var signature *signer.Signature
+	if signature, err = signer.Parse(r); err != nil {
+		return
+	}
+	if err = signature.CheckSkew(mgr.config.SignSkew); err != nil {
+		return
+	}
+
+	var accessKey *ModelUserAccessKey
+	if splits := strings.Split(signature.Credential, "/"); len(splits) == 2 {
+		accessKeyID, errID := strconv.Atoi(splits[1])
+		if errID != nil {
+			return false, nil, nil, signer.ErrorSignMalformed
+		}
+		ok, accessKey, err = mgr.getAccessKey(splits[0], accessKeyID)
+	} else {
+		ok, accessKey, err = mgr.getAccessKeyByKeyID(signature.Credential)
+	}
+	if err != nil {
+		return
+	} else if !ok {
+		return false, nil, nil, fmt.Errorf("accessKey not found")
+	}
+
+	if ok, err = signature.Verify(r, accessKey.AccessKey, mgr.config.SignMaxBodySize); err != nil || !ok {
+		return false, nil, nil, err
+	}
+
+	// 签名有效期内随机数只能使用一次
+	if err = mgr.useSignNonce(signature.Credential, signature.Nonce); err != nil {
+		return false, nil, nil, err
+	}
+
+	ip := tokenmgr.GetMeta(metas...).IP
+	if ip == "" {
+		if ip, _, err = net.SplitHostPort(r.RemoteAddr); err != nil {
+			ip, err = r.RemoteAddr, nil
+		}
+	}
+	mgr.recordAccessKeyUsage(accessKey.ID, ip)
+	if ok, user, err = mgr.FindUserByUID(accessKey.UID); err != nil || !ok {
+		return
+	}
+	return true, user, parseScopes(accessKey.Scopes), nil
+}
+
+func (mgr *UserMgr) useSignNonce(credential, nonce string) error {
+	conn := mgr.pool.Get()
+	defer conn.Close()
+
+	key := fmt.Sprintf("%s:sign:nonce:%s:%s", mgr.name, credential, nonce)
+	_, err := redigo.String(conn.Do("SET", key, "1", "EX", mgr.config.SignSkew*2, "NX"))
+	if err == redigo.ErrNil {
+		return signer.ErrorSignReplayed
+	}
+	return err
 }
 
 // VerifyAuth 验证第三方凭证
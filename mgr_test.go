@@ -0,0 +1,159 @@
+package gouser
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/cheetah-fun-gs/gouser/signer"
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+const (
+	testKeyID     = "2c5ea4c0b3a54f0e9d1b7f7a3c2e1d0f"
+	testAccessKey = "test-access-key"
+	testUID       = "test-uid"
+)
+
+// newTestMgr 使用 miniredis 和 sqlmock 的管理器 调用方需 defer closer()
+func newTestMgr(t *testing.T, config Config) (mgr *UserMgr, mock sqlmock.Sqlmock, closer func()) {
+	mgr, mock, _, closer = newTestMgrWithRedis(t, config)
+	return
+}
+
+// newTestMgrWithRedis 同 newTestMgr, 并返回 miniredis 用于推进时间
+func newTestMgrWithRedis(t *testing.T, config Config) (mgr *UserMgr, mock sqlmock.Sqlmock, mr *miniredis.Miniredis, closer func()) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := &redigo.Pool{
+		Dial: func() (redigo.Conn, error) {
+			return redigo.Dial("tcp", mr.Addr())
+		},
+	}
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		mr.Close()
+		t.Fatal(err)
+	}
+
+	mgr = New("test", "test-secret", pool, db, config)
+	return mgr, mock, mr, func() {
+		db.Close()
+		pool.Close()
+		mr.Close()
+	}
+}
+
+// expectAccessKey 回源查询访问密钥和所属用户 各一次, 之后命中缓存
+func expectAccessKey(t *testing.T, mgr *UserMgr, mock sqlmock.Sqlmock) {
+	sealed, err := mgr.sealAccessKey(testKeyID, testAccessKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery(`SELECT \* FROM test_user_access_key WHERE key_id = \?;`).WithArgs(testKeyID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "key_id", "access_key", "uid"}).AddRow(1, testKeyID, sealed, testUID))
+	mock.ExpectQuery(`SELECT \* FROM test_user WHERE uid = \?;`).WithArgs(testUID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "uid"}).AddRow(1, testUID))
+}
+
+func newSignedRequest(t *testing.T, body string) *http.Request {
+	r, err := http.NewRequest("POST", "https://api.example.com/v1/orders?limit=10", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if err = signer.Sign(r, testKeyID, testAccessKey, "Content-Type"); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestVerifyRequestSignReplay(t *testing.T) {
+	mgr, mock, closer := newTestMgr(t, Config{IsEnableAccessKey: true})
+	defer closer()
+	expectAccessKey(t, mgr, mock)
+
+	r := newSignedRequest(t, `{"amount":100}`)
+	ok, user, _, err := mgr.VerifyRequestSign(r)
+	if err != nil {
+		t.Fatalf("VerifyRequestSign err: %v", err)
+	}
+	if !ok || user == nil || user.UID != testUID {
+		t.Fatalf("VerifyRequestSign = %v %+v, want true %v", ok, user, testUID)
+	}
+
+	// 同一请求再次校验 随机数已使用
+	if ok, _, _, err = mgr.VerifyRequestSign(r); err != signer.ErrorSignReplayed {
+		t.Errorf("VerifyRequestSign replay = %v %v, want %v", ok, err, signer.ErrorSignReplayed)
+	}
+
+	// 新的随机数可以通过
+	if ok, _, _, err = mgr.VerifyRequestSign(newSignedRequest(t, `{"amount":100}`)); err != nil || !ok {
+		t.Errorf("VerifyRequestSign new nonce = %v %v, want true", ok, err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVerifyRequestSignSkew(t *testing.T) {
+	mgr, mock, closer := newTestMgr(t, Config{IsEnableAccessKey: true, SignSkew: 300})
+	defer closer()
+
+	for _, offset := range []time.Duration{-301 * time.Second, 301 * time.Second, -24 * time.Hour} {
+		r := newSignedRequest(t, `{"amount":100}`)
+		r.Header.Set(signer.HeaderDate, time.Now().Add(offset).UTC().Format(signer.TimeFormat))
+		if ok, _, _, err := mgr.VerifyRequestSign(r); err != signer.ErrorSignExpired {
+			t.Errorf("VerifyRequestSign offset %v = %v %v, want %v", offset, ok, err, signer.ErrorSignExpired)
+		}
+	}
+
+	// 时间校验先于查询密钥
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVerifyRequestSignTampered(t *testing.T) {
+	mgr, mock, closer := newTestMgr(t, Config{IsEnableAccessKey: true})
+	defer closer()
+	sealed, err := mgr.sealAccessKey(testKeyID, testAccessKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery(`SELECT \* FROM test_user_access_key WHERE key_id = \?;`).WithArgs(testKeyID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "key_id", "access_key", "uid"}).AddRow(1, testKeyID, sealed, testUID))
+
+	r := newSignedRequest(t, `{"amount":100}`)
+	r.Header.Set("Content-Type", "text/plain")
+	ok, _, _, err := mgr.VerifyRequestSign(r)
+	if err != nil || ok {
+		t.Errorf("VerifyRequestSign tampered = %v %v, want false nil", ok, err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVerifyRequestSignBodyTooLarge(t *testing.T) {
+	mgr, mock, closer := newTestMgr(t, Config{IsEnableAccessKey: true, SignMaxBodySize: 8})
+	defer closer()
+	sealed, err := mgr.sealAccessKey(testKeyID, testAccessKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery(`SELECT \* FROM test_user_access_key WHERE key_id = \?;`).WithArgs(testKeyID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "key_id", "access_key", "uid"}).AddRow(1, testKeyID, sealed, testUID))
+
+	r := newSignedRequest(t, `{"amount":100}`)
+	if ok, _, _, err := mgr.VerifyRequestSign(r); err != signer.ErrorBodyTooLarge {
+		t.Errorf("VerifyRequestSign = %v %v, want %v", ok, err, signer.ErrorBodyTooLarge)
+	}
+}
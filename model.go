@@ -10,7 +10,8 @@ const (
 	TableUser = `CREATE TABLE IF NOT EXISTS %v (
 		id int(10) unsigned NOT NULL AUTO_INCREMENT COMMENT '自增长ID',
 		uid char(22) NOT NULL COMMENT '用户ID',
-		password char(22) NOT NULL COMMENT '密码',
+		password varchar(255) NOT NULL COMMENT '密码',
+		password_changed timestamp NULL DEFAULT NULL COMMENT '密码修改时间',
 		email varchar(45) DEFAULT NULL COMMENT '邮箱',
 		mobile varchar(45) DEFAULT NULL COMMENT '手机号',
 		nickname varchar(64) NOT NULL COMMENT '昵称',
@@ -42,36 +43,90 @@ const (
 		KEY idx_created (created),
 		KEY idx_updated (updated)
 	  ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='第三方认证表'`
+	TableUserPasswordHistory = `CREATE TABLE IF NOT EXISTS %v (
+		id int(10) unsigned NOT NULL AUTO_INCREMENT COMMENT '自增长ID',
+		uid char(22) NOT NULL COMMENT '用户ID',
+		password varchar(255) NOT NULL COMMENT '密码',
+		created timestamp NOT NULL COMMENT '创建时间',
+		PRIMARY KEY (id),
+		KEY idx_uid (uid),
+		KEY idx_created (created)
+	  ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='历史密码表'`
 	TableUserAccessKey = `CREATE TABLE IF NOT EXISTS %v (
 		id int(10) unsigned NOT NULL AUTO_INCREMENT COMMENT '自增长ID',
-		access_key char(22) NOT NULL COMMENT '访问密钥',
+		key_id varchar(32) NOT NULL COMMENT '公开的密钥ID',
+		access_key varchar(255) NOT NULL COMMENT '访问密钥 加密存储',
 		uid char(22) NOT NULL COMMENT '用户ID',
+		scopes varchar(1000) NOT NULL DEFAULT '' COMMENT '权限范围 空格分隔 为空表示全部权限',
 		expire_at datetime DEFAULT NULL COMMENT '到期时间',
 		comment varchar(200) NOT NULL COMMENT '密钥注释',
+		last_used timestamp NULL DEFAULT NULL COMMENT '最后使用时间',
+		last_ip varchar(64) NOT NULL DEFAULT '' COMMENT '最后使用的IP',
+		use_count bigint(20) unsigned NOT NULL DEFAULT 0 COMMENT '累计使用次数',
 		created timestamp NOT NULL COMMENT '创建时间',
 		updated timestamp NOT NULL COMMENT '更新时间',
 		PRIMARY KEY (id),
-		UNIQUE KEY uniq_access_key (access_key),
+		UNIQUE KEY uniq_key_id (key_id),
 		KEY idx_uid (uid),
 		KEY idx_created (created),
 		KEY idx_updated (updated),
 		KEY idx_expire_at (expire_at)
 	  ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='访问密钥表'`
+	TableUserMFA = `CREATE TABLE IF NOT EXISTS %v (
+		id int(10) unsigned NOT NULL AUTO_INCREMENT COMMENT '自增长ID',
+		uid char(22) NOT NULL COMMENT '用户ID',
+		mfa_type varchar(45) NOT NULL COMMENT '认证类型',
+		secret varchar(255) NOT NULL COMMENT '密钥 加密存储',
+		enabled tinyint(1) NOT NULL DEFAULT '0' COMMENT '是否已启用',
+		created timestamp NOT NULL COMMENT '创建时间',
+		updated timestamp NOT NULL COMMENT '更新时间',
+		PRIMARY KEY (id),
+		UNIQUE KEY uniq_uid_mfa_type (uid,mfa_type),
+		KEY idx_created (created),
+		KEY idx_updated (updated)
+	  ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='多因素认证表'`
+	TableUserRecoveryCode = `CREATE TABLE IF NOT EXISTS %v (
+		id int(10) unsigned NOT NULL AUTO_INCREMENT COMMENT '自增长ID',
+		uid char(22) NOT NULL COMMENT '用户ID',
+		code_hash char(64) NOT NULL COMMENT '恢复码哈希',
+		created timestamp NOT NULL COMMENT '创建时间',
+		PRIMARY KEY (id),
+		UNIQUE KEY uniq_uid_code_hash (uid,code_hash),
+		KEY idx_created (created)
+	  ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='恢复码表'`
+	TableUserWebAuthn = `CREATE TABLE IF NOT EXISTS %v (
+		id int(10) unsigned NOT NULL AUTO_INCREMENT COMMENT '自增长ID',
+		uid char(22) NOT NULL COMMENT '用户ID',
+		credential_id varchar(255) NOT NULL COMMENT '凭证ID',
+		public_key varchar(1024) NOT NULL COMMENT '凭证公钥',
+		sign_count int(10) unsigned NOT NULL DEFAULT '0' COMMENT '签名计数',
+		aaguid char(32) NOT NULL COMMENT '认证器型号',
+		name varchar(64) NOT NULL COMMENT '凭证名称',
+		last_used timestamp NULL DEFAULT NULL COMMENT '最后使用时间',
+		created timestamp NOT NULL COMMENT '创建时间',
+		updated timestamp NOT NULL COMMENT '更新时间',
+		PRIMARY KEY (id),
+		UNIQUE KEY uniq_credential_id (credential_id),
+		KEY idx_uid (uid),
+		KEY idx_created (created),
+		KEY idx_updated (updated)
+	  ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='WebAuthn凭证表'`
 )
 
 // ModelUser 用户表
 type ModelUser struct {
-	ID        int            `json:"id,omitempty"`
-	UID       string         `json:"uid,omitempty"`
-	Password  string         `json:"password,omitempty"`
-	Email     sql.NullString `json:"email,omitempty"`
-	Mobile    sql.NullString `json:"mobile,omitempty"`
-	Nickname  string         `json:"nickname,omitempty"`
-	Avatar    string         `json:"avatar,omitempty"`
-	Extra     string         `json:"extra,omitempty"`
-	LastLogin time.Time      `json:"last_login,omitempty"`
-	Created   time.Time      `json:"created,omitempty"`
-	Updated   time.Time      `json:"updated,omitempty"`
+	ID              int            `json:"id,omitempty"`
+	UID             string         `json:"uid,omitempty"`
+	Password        string         `json:"password,omitempty"`
+	PasswordChanged sql.NullTime   `json:"password_changed,omitempty"`
+	Email           sql.NullString `json:"email,omitempty"`
+	Mobile          sql.NullString `json:"mobile,omitempty"`
+	Nickname        string         `json:"nickname,omitempty"`
+	Avatar          string         `json:"avatar,omitempty"`
+	Extra           string         `json:"extra,omitempty"`
+	LastLogin       time.Time      `json:"last_login,omitempty"`
+	Created         time.Time      `json:"created,omitempty"`
+	Updated         time.Time      `json:"updated,omitempty"`
 }
 
 // ModelUserAuth 用户和第三方认证绑定表
@@ -85,13 +140,59 @@ type ModelUserAuth struct {
 	Updated   time.Time `json:"updated,omitempty"`
 }
 
+// ModelUserPasswordHistory 历史密码
+type ModelUserPasswordHistory struct {
+	ID       int       `json:"id,omitempty"`
+	UID      string    `json:"uid,omitempty"` // ModelUser UID
+	Password string    `json:"password,omitempty"`
+	Created  time.Time `json:"created,omitempty"`
+}
+
 // ModelUserAccessKey 访问密钥
 type ModelUserAccessKey struct {
 	ID        int          `json:"id,omitempty"`
+	KeyID     string       `json:"key_id,omitempty"`
 	AccessKey string       `json:"access_key,omitempty"`
 	UID       string       `json:"uid,omitempty"` // ModelUser UID
+	Scopes    string       `json:"scopes,omitempty"`
 	ExpireAt  sql.NullTime `json:"expire_at,omitempty"`
 	Comment   string       `json:"comment,omitempty"`
+	LastUsed  sql.NullTime `json:"last_used,omitempty"`
+	LastIP    string       `json:"last_ip,omitempty"`
+	UseCount  int64        `json:"use_count,omitempty"`
 	Created   time.Time    `json:"created,omitempty"`
 	Updated   time.Time    `json:"updated,omitempty"`
 }
+
+// ModelUserMFA 多因素认证
+type ModelUserMFA struct {
+	ID      int       `json:"id,omitempty"`
+	UID     string    `json:"uid,omitempty"` // ModelUser UID
+	MFAType string    `json:"mfa_type,omitempty"`
+	Secret  string    `json:"secret,omitempty"`
+	Enabled int       `json:"enabled,omitempty"`
+	Created time.Time `json:"created,omitempty"`
+	Updated time.Time `json:"updated,omitempty"`
+}
+
+// ModelUserRecoveryCode 恢复码 只保存哈希
+type ModelUserRecoveryCode struct {
+	ID       int       `json:"id,omitempty"`
+	UID      string    `json:"uid,omitempty"` // ModelUser UID
+	CodeHash string    `json:"code_hash,omitempty"`
+	Created  time.Time `json:"created,omitempty"`
+}
+
+// ModelUserWebAuthn WebAuthn 凭证
+type ModelUserWebAuthn struct {
+	ID           int          `json:"id,omitempty"`
+	UID          string       `json:"uid,omitempty"`           // ModelUser UID
+	CredentialID string       `json:"credential_id,omitempty"` // base64url
+	PublicKey    string       `json:"public_key,omitempty"`    // base64url COSE
+	SignCount    int64        `json:"sign_count,omitempty"`
+	AAGUID       string       `json:"aaguid,omitempty"` // hex
+	Name         string       `json:"name,omitempty"`
+	LastUsed     sql.NullTime `json:"last_used,omitempty"`
+	Created      time.Time    `json:"created,omitempty"`
+	Updated      time.Time    `json:"updated,omitempty"`
+}
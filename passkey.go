@@ -0,0 +1,395 @@
+// Package gouser WebAuthn(passkey) 注册和登录
+package gouser
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	sqlplus "github.com/cheetah-fun-gs/goplus/dao/sql"
+	mlogger "github.com/cheetah-fun-gs/goplus/multier/multilogger"
+	"github.com/cheetah-fun-gs/gouser/tokenmgr"
+	"github.com/cheetah-fun-gs/gouser/webauthn"
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+// 仪式类型
+const (
+	webauthnCeremonyRegister = "register"
+	webauthnCeremonyLogin    = "login"
+)
+
+// UserWebAuthnCredential WebAuthn 凭证
+type UserWebAuthnCredential struct {
+	ID           int    `json:"id,omitempty"`
+	CredentialID string `json:"credential_id,omitempty"` // base64url
+	Name         string `json:"name,omitempty"`
+	SignCount    int64  `json:"sign_count,omitempty"`
+	AAGUID       string `json:"aaguid,omitempty"`
+	LastUsed     int64  `json:"last_used,omitempty"`
+	Created      int64  `json:"created,omitempty"`
+}
+
+type webauthnChallengeValue struct {
+	Ceremony string `json:"ceremony,omitempty"`
+	UID      string `json:"uid,omitempty"` // 登录时可为空
+}
+
+func getWebAuthnChallengeKey(name, challenge string) string {
+	return fmt.Sprintf("%s:webauthn:%s", name, challenge)
+}
+
+// 取出并删除挑战 挑战只能使用一次
+var takeWebAuthnChallengeScript = redigo.NewScript(1, `local value = redis.call("GET", KEYS[1])
+	if value
+	then
+		redis.call("DEL", KEYS[1])
+	end
+	return value`)
+
+func (mgr *UserMgr) checkWebAuthn() error {
+	if mgr.webauthnMgr == nil {
+		return fmt.Errorf("WebAuthn is not enable")
+	}
+	return nil
+}
+
+func (mgr *UserMgr) newWebAuthnChallenge(ceremony, uid string) (string, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(&webauthnChallengeValue{Ceremony: ceremony, UID: uid})
+	if err != nil {
+		return "", err
+	}
+
+	conn := mgr.pool.Get()
+	defer conn.Close()
+
+	if _, err = conn.Do("SET", getWebAuthnChallengeKey(mgr.name, challenge), string(data),
+		"EX", mgr.webauthnMgr.GetTimeout()); err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+// takeWebAuthnChallenge 根据客户端数据取出挑战 不存在或仪式不符返回错误
+func (mgr *UserMgr) takeWebAuthnChallenge(ceremony, clientDataJSON string) (challenge string, value *webauthnChallengeValue, err error) {
+	var raw []byte
+	if raw, err = webauthn.Encoding.DecodeString(clientDataJSON); err != nil {
+		return
+	}
+	var clientData *webauthn.ClientData
+	if clientData, err = webauthn.ParseClientData(raw); err != nil {
+		return
+	}
+	challenge = clientData.Challenge
+
+	conn := mgr.pool.Get()
+	defer conn.Close()
+
+	var data string
+	if data, err = redigo.String(takeWebAuthnChallengeScript.Do(conn, getWebAuthnChallengeKey(mgr.name, challenge))); err == redigo.ErrNil {
+		err = fmt.Errorf("webauthn challenge is invalid")
+		return
+	} else if err != nil {
+		return
+	}
+
+	value = &webauthnChallengeValue{}
+	if err = json.Unmarshal([]byte(data), value); err != nil {
+		return
+	}
+	if value.Ceremony != ceremony {
+		err = fmt.Errorf("webauthn challenge is invalid")
+		return
+	}
+	return
+}
+
+// findWebAuthnCredential 根据凭证ID查找凭证 不存在返回 ErrorNotFound
+func (mgr *UserMgr) findWebAuthnCredential(credentialID string) (*ModelUserWebAuthn, error) {
+	query := fmt.Sprintf("SELECT * FROM %v WHERE credential_id = ?;", mgr.tableUserWebAuthn.Name)
+	args := []interface{}{credentialID}
+
+	rows, err := mgr.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := &ModelUserWebAuthn{}
+	if err = sqlplus.Get(rows, result); err == sql.ErrNoRows {
+		return nil, ErrorNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// BeginWebAuthnLogin WebAuthn 登录 生成登录选项, 传给客户端 navigator.credentials.get
+// uids 可选, 指定用户时只允许该用户的凭证; 不指定时使用可发现凭证(passkey)
+func (mgr *UserMgr) BeginWebAuthnLogin(uids ...string) (*webauthn.RequestOptions, error) {
+	if err := mgr.checkWebAuthn(); err != nil {
+		return nil, err
+	}
+
+	var uid string
+	allows := [][]byte{}
+	if len(uids) > 0 {
+		uid = uids[0]
+		ok, user, err := mgr.FindUserByUID(uid)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, ErrorNotFound
+		}
+		if allows, err = user.getWebAuthnCredentialIDs(); err != nil {
+			return nil, err
+		}
+		if len(allows) == 0 {
+			return nil, ErrorNotFound
+		}
+	}
+
+	challenge, err := mgr.newWebAuthnChallenge(webauthnCeremonyLogin, uid)
+	if err != nil {
+		return nil, err
+	}
+	return mgr.webauthnMgr.RequestOptions(challenge, allows...), nil
+}
+
+// LoginWebAuthn WebAuthn 登录
+func (mgr *UserMgr) LoginWebAuthn(response *webauthn.AssertionResponse) (user *User, token string, deadline int64, err error) {
+	return mgr.LoginWebAuthnWithFrom(response, fromDefault)
+}
+
+// LoginWebAuthnWithFrom WebAuthn 登录 带来源 校验通过后更新凭证的签名计数
+func (mgr *UserMgr) LoginWebAuthnWithFrom(response *webauthn.AssertionResponse, from string, metas ...*tokenmgr.SessionMeta) (user *User, token string, deadline int64, err error) {
+	if err = mgr.checkWebAuthn(); err != nil {
+		return
+	}
+
+	var challenge string
+	var value *webauthnChallengeValue
+	if challenge, value, err = mgr.takeWebAuthnChallenge(webauthnCeremonyLogin, response.Response.ClientDataJSON); err != nil {
+		return
+	}
+
+	var credential *ModelUserWebAuthn
+	if credential, err = mgr.findWebAuthnCredential(response.RawID); err != nil {
+		return
+	}
+	if value.UID != "" && value.UID != credential.UID {
+		err = ErrorNotFound
+		return
+	}
+	if response.Response.UserHandle != "" {
+		var userHandle []byte
+		if userHandle, err = webauthn.Encoding.DecodeString(response.Response.UserHandle); err != nil {
+			return
+		}
+		if string(userHandle) != credential.UID {
+			err = ErrorNotFound
+			return
+		}
+	}
+
+	var publicKey []byte
+	if publicKey, err = webauthn.Encoding.DecodeString(credential.PublicKey); err != nil {
+		return
+	}
+	var signCount uint32
+	if signCount, err = mgr.webauthnMgr.VerifyAssertion(challenge, publicKey, uint32(credential.SignCount), response); err != nil {
+		return
+	}
+
+	// 签名计数只增不减 并发登录时只有一个成功
+	now := time.Now()
+	query := fmt.Sprintf("UPDATE %v Set sign_count = ?, last_used = ?, updated = ? WHERE id = ? AND sign_count = ?;",
+		mgr.tableUserWebAuthn.Name)
+	args := []interface{}{signCount, now, now, credential.ID, credential.SignCount}
+	var n int
+	if n, err = sqlplus.RowsAffected(mgr.db.Exec(query, args...)); err != nil {
+		return
+	}
+	if n == 0 && signCount != 0 {
+		err = webauthn.ErrorSignCount
+		return
+	}
+
+	var ok bool
+	if ok, user, err = mgr.FindUserByUID(credential.UID); err != nil {
+		return
+	} else if !ok {
+		err = ErrorNotFound
+		return
+	}
+
+	if token, deadline, err = user.LoginWithFrom(from, metas...); err != nil {
+		return nil, "", 0, err
+	}
+	return
+}
+
+func (user *User) getWebAuthnCredentials() ([]*ModelUserWebAuthn, error) {
+	query := fmt.Sprintf("SELECT * FROM %v WHERE uid = ?;", user.mgr.tableUserWebAuthn.Name)
+	args := []interface{}{user.UID}
+
+	rows, err := user.mgr.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []*ModelUserWebAuthn{}
+	if err = sqlplus.Select(rows, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (user *User) getWebAuthnCredentialIDs() ([][]byte, error) {
+	credentials, err := user.getWebAuthnCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := [][]byte{}
+	for _, val := range credentials {
+		id, err := webauthn.Encoding.DecodeString(val.CredentialID)
+		if err != nil {
+			mlogger.WarnN(user.mgr.mlogname, "getWebAuthnCredentialIDs %v %v err: %v", user.UID, val.ID, err)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// BeginWebAuthnRegistration 开始注册 WebAuthn 凭证 生成注册选项, 传给客户端 navigator.credentials.create
+func (user *User) BeginWebAuthnRegistration() (*webauthn.CreationOptions, error) {
+	if err := user.mgr.checkWebAuthn(); err != nil {
+		return nil, err
+	}
+
+	excludes, err := user.getWebAuthnCredentialIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	challenge, err := user.mgr.newWebAuthnChallenge(webauthnCeremonyRegister, user.UID)
+	if err != nil {
+		return nil, err
+	}
+
+	name := user.UID
+	if user.Email != "" {
+		name = user.Email
+	} else if user.Mobile != "" {
+		name = user.Mobile
+	}
+	displayName := user.Nickname
+	if displayName == "" {
+		displayName = name
+	}
+	return user.mgr.webauthnMgr.CreationOptions(challenge, []byte(user.UID), name, displayName, excludes...), nil
+}
+
+// FinishWebAuthnRegistration 完成注册 WebAuthn 凭证 name 为凭证名称, 便于用户区分设备
+func (user *User) FinishWebAuthnRegistration(name string, response *webauthn.AttestationResponse) (*UserWebAuthnCredential, error) {
+	if err := user.mgr.checkWebAuthn(); err != nil {
+		return nil, err
+	}
+
+	challenge, value, err := user.mgr.takeWebAuthnChallenge(webauthnCeremonyRegister, response.Response.ClientDataJSON)
+	if err != nil {
+		return nil, err
+	}
+	if value.UID != user.UID {
+		return nil, fmt.Errorf("webauthn challenge is invalid")
+	}
+
+	credential, err := user.mgr.webauthnMgr.VerifyRegistration(challenge, response)
+	if err != nil {
+		return nil, err
+	}
+
+	credentialID := webauthn.Encoding.EncodeToString(credential.ID)
+	if len(credentialID) > 255 {
+		return nil, fmt.Errorf("credential id is too long")
+	}
+
+	now := time.Now()
+	data := &ModelUserWebAuthn{
+		UID:          user.UID,
+		CredentialID: credentialID,
+		PublicKey:    webauthn.Encoding.EncodeToString(credential.PublicKey),
+		SignCount:    int64(credential.SignCount),
+		AAGUID:       hex.EncodeToString(credential.AAGUID),
+		Name:         name,
+		Created:      now,
+		Updated:      now,
+	}
+	query, args := sqlplus.GenInsert(user.mgr.tableUserWebAuthn.Name, data)
+	aid, err := sqlplus.LastInsertId(user.mgr.db.Exec(query, args...))
+	if err != nil {
+		return nil, err
+	}
+
+	return &UserWebAuthnCredential{
+		ID:           aid,
+		CredentialID: data.CredentialID,
+		Name:         data.Name,
+		SignCount:    data.SignCount,
+		AAGUID:       data.AAGUID,
+		Created:      now.Unix(),
+	}, nil
+}
+
+// GetWebAuthnCredentials 获得 WebAuthn 凭证列表
+func (user *User) GetWebAuthnCredentials() ([]*UserWebAuthnCredential, error) {
+	if err := user.mgr.checkWebAuthn(); err != nil {
+		return nil, err
+	}
+
+	result, err := user.getWebAuthnCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	credentials := []*UserWebAuthnCredential{}
+	for _, val := range result {
+		credential := &UserWebAuthnCredential{
+			ID:           val.ID,
+			CredentialID: val.CredentialID,
+			Name:         val.Name,
+			SignCount:    val.SignCount,
+			AAGUID:       val.AAGUID,
+			Created:      val.Created.Unix(),
+		}
+		if val.LastUsed.Valid {
+			credential.LastUsed = val.LastUsed.Time.Unix()
+		}
+		credentials = append(credentials, credential)
+	}
+	return credentials, nil
+}
+
+// DeleteWebAuthnCredential 删除一个 WebAuthn 凭证
+func (user *User) DeleteWebAuthnCredential(credentialID int) error {
+	query := fmt.Sprintf("DELETE FROM %v WHERE id = ? AND uid = ?;", user.mgr.tableUserWebAuthn.Name)
+	args := []interface{}{credentialID, user.UID}
+	n, err := sqlplus.RowsAffected(user.mgr.db.Exec(query, args...))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrorNotFound
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package passwordhasher
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const argon2idPrefix = "$argon2id$"
+
+// 解析已保存的哈希时允许的参数范围 超出范围视为格式错误, 防止异常数据导致 panic 或耗尽内存
+const (
+	argon2idMaxTime    = 100         // 最大迭代次数
+	argon2idMaxMemory  = 1024 * 1024 // 最大内存 KiB
+	argon2idMinSaltLen = 8           // 最短盐 RFC 9106
+	argon2idMinKeyLen  = 4           // 最短哈希 RFC 9106
+)
+
+// Argon2idHasher argon2id 哈希
+// 格式: $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+type Argon2idHasher struct {
+	Time    uint32 // 迭代次数
+	Memory  uint32 // 内存 KiB
+	Threads uint8  // 并行度
+	SaltLen uint32 // 盐长度
+	KeyLen  uint32 // 哈希长度
+}
+
+// NewArgon2id 获得一个 argon2id 哈希 使用 RFC 9106 第二推荐参数(t=3, m=64MiB, p=4)
+func NewArgon2id() *Argon2idHasher {
+	return &Argon2idHasher{
+		Time:    3,
+		Memory:  64 * 1024,
+		Threads: 4,
+		SaltLen: 16,
+		KeyLen:  32,
+	}
+}
+
+type argon2idParams struct {
+	version int
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func parseArgon2id(password string) (*argon2idParams, error) {
+	// "", "argon2id", "v=19", "m=65536,t=3,p=4", salt, hash
+	splits := strings.Split(password, "$")
+	if len(splits) != 6 || splits[1] != "argon2id" {
+		return nil, ErrorUnknownFormat
+	}
+
+	params := &argon2idParams{}
+	if _, err := fmt.Sscanf(splits[2], "v=%d", &params.version); err != nil {
+		return nil, ErrorMalformed
+	}
+	if params.version != argon2.Version {
+		return nil, fmt.Errorf("argon2id version %v is not support", params.version)
+	}
+	if _, err := fmt.Sscanf(splits[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return nil, ErrorMalformed
+	}
+	if params.time < 1 || params.time > argon2idMaxTime || params.threads < 1 ||
+		params.memory < 8*uint32(params.threads) || params.memory > argon2idMaxMemory {
+		return nil, ErrorMalformed
+	}
+
+	var err error
+	if params.salt, err = base64.RawStdEncoding.DecodeString(splits[4]); err != nil || len(params.salt) < argon2idMinSaltLen {
+		return nil, ErrorMalformed
+	}
+	if params.key, err = base64.RawStdEncoding.DecodeString(splits[5]); err != nil || len(params.key) < argon2idMinKeyLen {
+		return nil, ErrorMalformed
+	}
+	return params, nil
+}
+
+func verifyArgon2id(rawPassword, password string) (bool, error) {
+	params, err := parseArgon2id(password)
+	if err != nil {
+		return false, err
+	}
+
+	key := argon2.IDKey([]byte(rawPassword), params.salt, params.time, params.memory, params.threads, uint32(len(params.key)))
+	return subtle.ConstantTimeCompare(key, params.key) == 1, nil
+}
+
+// Hash ...
+func (h *Argon2idHasher) Hash(rawPassword string) (string, error) {
+	salt := make([]byte, h.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(rawPassword), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version, h.Memory, h.Time, h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify 可校验所有内置算法的哈希
+func (h *Argon2idHasher) Verify(rawPassword, password string) (bool, error) {
+	return Verify(rawPassword, password)
+}
+
+// NeedRehash 非 argon2id 或参数不一致时需要重新生成
+func (h *Argon2idHasher) NeedRehash(password string) bool {
+	params, err := parseArgon2id(password)
+	if err != nil {
+		return true
+	}
+	return params.memory != h.Memory || params.time != h.Time || params.threads != h.Threads ||
+		uint32(len(params.salt)) != h.SaltLen || uint32(len(params.key)) != h.KeyLen
+}
@@ -0,0 +1,61 @@
+package passwordhasher
+
+import (
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// BcryptHasher bcrypt 哈希
+// 格式: $2a$10$<salt+hash>
+type BcryptHasher struct {
+	Cost int // 计算成本
+}
+
+// NewBcrypt 获得一个 bcrypt 哈希 cost 为0时使用默认值
+func NewBcrypt(cost int) *BcryptHasher {
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+	return &BcryptHasher{Cost: cost}
+}
+
+func isBcrypt(password string) bool {
+	return strings.HasPrefix(password, "$2a$") || strings.HasPrefix(password, "$2b$") || strings.HasPrefix(password, "$2y$")
+}
+
+func verifyBcrypt(rawPassword, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(password), []byte(rawPassword))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Hash ...
+func (h *BcryptHasher) Hash(rawPassword string) (string, error) {
+	password, err := bcrypt.GenerateFromPassword([]byte(rawPassword), h.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(password), nil
+}
+
+// Verify 可校验所有内置算法的哈希
+func (h *BcryptHasher) Verify(rawPassword, password string) (bool, error) {
+	return Verify(rawPassword, password)
+}
+
+// NeedRehash 非 bcrypt 或 cost 不一致时需要重新生成
+func (h *BcryptHasher) NeedRehash(password string) bool {
+	if !isBcrypt(password) {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(password))
+	if err != nil {
+		return true
+	}
+	return cost != h.Cost
+}
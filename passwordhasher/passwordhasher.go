@@ -0,0 +1,36 @@
+// Package passwordhasher 密码哈希 存储格式自描述(算法+参数+盐), 内置 argon2id 和 bcrypt
+package passwordhasher
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PasswordHasher 密码哈希定义
+type PasswordHasher interface {
+	Hash(rawPassword string) (password string, err error) // 生成密码哈希
+	Verify(rawPassword, password string) (bool, error)    // 校验密码
+	NeedRehash(password string) bool                      // 密码哈希是否需要按当前算法和参数重新生成
+}
+
+// 错误
+var (
+	ErrorUnknownFormat = fmt.Errorf("unknown password format")    // 无法识别的哈希格式
+	ErrorMalformed     = fmt.Errorf("password hash is malformed") // 哈希格式可以识别, 但内容或参数无效
+)
+
+// IsHashed 是否为本包生成的自描述格式
+func IsHashed(password string) bool {
+	return strings.HasPrefix(password, "$")
+}
+
+// Verify 校验任一内置算法生成的密码哈希
+func Verify(rawPassword, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(password, argon2idPrefix):
+		return verifyArgon2id(rawPassword, password)
+	case isBcrypt(password):
+		return verifyBcrypt(rawPassword, password)
+	}
+	return false, ErrorUnknownFormat
+}
@@ -0,0 +1,204 @@
+package passwordhasher
+
+import (
+	"strings"
+	"testing"
+)
+
+// 测试使用低成本参数
+func newTestArgon2id() *Argon2idHasher {
+	return &Argon2idHasher{Time: 1, Memory: 64, Threads: 1, SaltLen: 16, KeyLen: 32}
+}
+
+func TestRoundTrip(t *testing.T) {
+	hashers := map[string]PasswordHasher{
+		"argon2id":         newTestArgon2id(),
+		"argon2id default": NewArgon2id(),
+		"bcrypt":           NewBcrypt(4),
+	}
+	for name, hasher := range hashers {
+		password, err := hasher.Hash("p@ssw0rd")
+		if err != nil {
+			t.Fatalf("%v Hash err: %v", name, err)
+		}
+		if !IsHashed(password) {
+			t.Errorf("%v IsHashed(%v) = false, want true", name, password)
+		}
+
+		// 每次生成的盐不同
+		other, err := hasher.Hash("p@ssw0rd")
+		if err != nil {
+			t.Fatalf("%v Hash err: %v", name, err)
+		}
+		if other == password {
+			t.Errorf("%v Hash twice returns the same hash", name)
+		}
+
+		for _, c := range []struct {
+			raw string
+			ok  bool
+		}{
+			{"p@ssw0rd", true},
+			{"p@ssw0rD", false},
+			{"", false},
+		} {
+			ok, err := hasher.Verify(c.raw, password)
+			if err != nil {
+				t.Errorf("%v Verify(%q) err: %v", name, c.raw, err)
+			}
+			if ok != c.ok {
+				t.Errorf("%v Verify(%q) = %v, want %v", name, c.raw, ok, c.ok)
+			}
+		}
+		if hasher.NeedRehash(password) {
+			t.Errorf("%v NeedRehash own hash = true, want false", name)
+		}
+	}
+}
+
+func TestArgon2idFormat(t *testing.T) {
+	password, err := newTestArgon2id().Hash("p@ssw0rd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefix := "$argon2id$v=19$m=64,t=1,p=1$"; !strings.HasPrefix(password, prefix) {
+		t.Errorf("Hash = %v, want prefix %v", password, prefix)
+	}
+
+	// 参数取自哈希本身 与当前哈希器配置无关
+	if ok, err := NewArgon2id().Verify("p@ssw0rd", password); err != nil || !ok {
+		t.Errorf("Verify with other params = %v %v, want true", ok, err)
+	}
+}
+
+func TestVerifyCrossAlgorithm(t *testing.T) {
+	argon2idHasher, bcryptHasher := newTestArgon2id(), NewBcrypt(4)
+	argon2idPassword, err := argon2idHasher.Hash("p@ssw0rd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptPassword, err := bcryptHasher.Hash("p@ssw0rd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := argon2idHasher.Verify("p@ssw0rd", bcryptPassword); err != nil || !ok {
+		t.Errorf("argon2id Verify bcrypt hash = %v %v, want true", ok, err)
+	}
+	if ok, err := bcryptHasher.Verify("p@ssw0rd", argon2idPassword); err != nil || !ok {
+		t.Errorf("bcrypt Verify argon2id hash = %v %v, want true", ok, err)
+	}
+	if !argon2idHasher.NeedRehash(bcryptPassword) {
+		t.Error("argon2id NeedRehash bcrypt hash = false, want true")
+	}
+	if !bcryptHasher.NeedRehash(argon2idPassword) {
+		t.Error("bcrypt NeedRehash argon2id hash = false, want true")
+	}
+}
+
+func TestNeedRehash(t *testing.T) {
+	password, err := newTestArgon2id().Hash("p@ssw0rd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := map[string]func(h *Argon2idHasher){
+		"time":    func(h *Argon2idHasher) { h.Time = 2 },
+		"memory":  func(h *Argon2idHasher) { h.Memory = 128 },
+		"threads": func(h *Argon2idHasher) { h.Threads = 2 },
+		"saltLen": func(h *Argon2idHasher) { h.SaltLen = 32 },
+		"keyLen":  func(h *Argon2idHasher) { h.KeyLen = 64 },
+	}
+	for name, change := range changes {
+		hasher := newTestArgon2id()
+		change(hasher)
+		if !hasher.NeedRehash(password) {
+			t.Errorf("argon2id NeedRehash with %v changed = false, want true", name)
+		}
+	}
+
+	bcryptPassword, err := NewBcrypt(4).Hash("p@ssw0rd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !NewBcrypt(5).NeedRehash(bcryptPassword) {
+		t.Error("bcrypt NeedRehash with cost changed = false, want true")
+	}
+
+	// 旧格式(UUIDv5)和无法解析的哈希都需要重新生成
+	for _, hasher := range []PasswordHasher{newTestArgon2id(), NewBcrypt(4)} {
+		for _, stored := range []string{"6ba7b810-9dad-51d1-80b4-00c04fd430c8", "", "$argon2id$v=19$m=0,t=0,p=0$$", "$2a$10$short"} {
+			if !hasher.NeedRehash(stored) {
+				t.Errorf("%T NeedRehash(%q) = false, want true", hasher, stored)
+			}
+		}
+	}
+}
+
+func TestVerifyMalformed(t *testing.T) {
+	const (
+		salt = "c2FsdHNhbHRzYWx0c2FsdA"                      // 16 字节
+		key  = "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U" // 32 字节
+	)
+	cases := map[string]struct {
+		password string
+		err      error
+	}{
+		"argon2id t=0":          {"$argon2id$v=19$m=64,t=0,p=1$" + salt + "$" + key, ErrorMalformed},
+		"argon2id t too large":  {"$argon2id$v=19$m=64,t=4294967295,p=1$" + salt + "$" + key, ErrorMalformed},
+		"argon2id p=0":          {"$argon2id$v=19$m=64,t=1,p=0$" + salt + "$" + key, ErrorMalformed},
+		"argon2id p overflow":   {"$argon2id$v=19$m=64,t=1,p=300$" + salt + "$" + key, ErrorMalformed},
+		"argon2id m=0":          {"$argon2id$v=19$m=0,t=1,p=1$" + salt + "$" + key, ErrorMalformed},
+		"argon2id m < 8p":       {"$argon2id$v=19$m=8,t=1,p=2$" + salt + "$" + key, ErrorMalformed},
+		"argon2id m too large":  {"$argon2id$v=19$m=4294967295,t=1,p=1$" + salt + "$" + key, ErrorMalformed},
+		"argon2id m negative":   {"$argon2id$v=19$m=-1,t=1,p=1$" + salt + "$" + key, ErrorMalformed},
+		"argon2id bad params":   {"$argon2id$v=19$t=1$" + salt + "$" + key, ErrorMalformed},
+		"argon2id bad version":  {"$argon2id$v=x$m=64,t=1,p=1$" + salt + "$" + key, ErrorMalformed},
+		"argon2id empty salt":   {"$argon2id$v=19$m=64,t=1,p=1$$" + key, ErrorMalformed},
+		"argon2id short salt":   {"$argon2id$v=19$m=64,t=1,p=1$c2FsdA$" + key, ErrorMalformed},
+		"argon2id empty hash":   {"$argon2id$v=19$m=64,t=1,p=1$" + salt + "$", ErrorMalformed},
+		"argon2id bad base64":   {"$argon2id$v=19$m=64,t=1,p=1$" + salt + "$!!!!", ErrorMalformed},
+		"argon2id padded salt":  {"$argon2id$v=19$m=64,t=1,p=1$" + salt + "==$" + key, ErrorMalformed},
+		"argon2id wrong fields": {"$argon2id$v=19$m=64,t=1,p=1$" + salt, ErrorUnknownFormat},
+		"argon2i":               {"$argon2i$v=19$m=64,t=1,p=1$" + salt + "$" + key, ErrorUnknownFormat},
+		"unknown prefix":        {"$1$salt$hash", ErrorUnknownFormat},
+		"legacy":                {"6ba7b810-9dad-51d1-80b4-00c04fd430c8", ErrorUnknownFormat},
+		"empty":                 {"", ErrorUnknownFormat},
+	}
+	// 参数有效时仅是密码不匹配
+	if ok, err := Verify("p@ssw0rd", "$argon2id$v=19$m=64,t=1,p=1$"+salt+"$"+key); ok || err != nil {
+		t.Fatalf("Verify valid params = %v %v, want false nil", ok, err)
+	}
+
+	for name, c := range cases {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("Verify %v panic: %v", name, r)
+				}
+			}()
+			ok, err := Verify("p@ssw0rd", c.password)
+			if ok || err != c.err {
+				t.Errorf("Verify %v = %v %v, want false %v", name, ok, err, c.err)
+			}
+		}()
+	}
+
+	// 其他错误 只要求返回错误且不 panic
+	for name, password := range map[string]string{
+		"argon2id version 16": "$argon2id$v=16$m=64,t=1,p=1$" + salt + "$" + key,
+		"bcrypt short":        "$2a$10$short",
+		"bcrypt cost 99":      "$2a$99$" + strings.Repeat("a", 53),
+		"bcrypt bad cost":     "$2b$xx$" + strings.Repeat("a", 53),
+	} {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("Verify %v panic: %v", name, r)
+				}
+			}()
+			if ok, err := Verify("p@ssw0rd", password); ok || err == nil {
+				t.Errorf("Verify %v = %v %v, want false and an error", name, ok, err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,115 @@
+// Package gouser 历史密码和密码过期
+package gouser
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	sqlplus "github.com/cheetah-fun-gs/goplus/dao/sql"
+	mlogger "github.com/cheetah-fun-gs/goplus/multier/multilogger"
+)
+
+// addPasswordHistory 记录密码 只保留最近 PasswordHistory 条
+func (mgr *UserMgr) addPasswordHistory(uid, password string, now time.Time) error {
+	if mgr.config.PasswordHistory <= 0 {
+		return nil
+	}
+
+	data := &ModelUserPasswordHistory{
+		UID:      uid,
+		Password: password,
+		Created:  now,
+	}
+	query, args := sqlplus.GenInsert(mgr.tablePasswordHist.Name, data)
+	if _, err := sqlplus.LastInsertId(mgr.db.Exec(query, args...)); err != nil {
+		return err
+	}
+
+	queryOldest := fmt.Sprintf("SELECT id FROM %v WHERE uid = ? ORDER BY id DESC LIMIT 1 OFFSET ?;", mgr.tablePasswordHist.Name)
+	argsOldest := []interface{}{uid, mgr.config.PasswordHistory - 1}
+	var oldest int
+	if err := mgr.db.QueryRow(queryOldest, argsOldest...).Scan(&oldest); err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	queryDelete := fmt.Sprintf("DELETE FROM %v WHERE uid = ? AND id < ?;", mgr.tablePasswordHist.Name)
+	argsDelete := []interface{}{uid, oldest}
+	_, err := sqlplus.RowsAffected(mgr.db.Exec(queryDelete, argsDelete...))
+	return err
+}
+
+// checkPasswordReused 新密码不能是当前密码或最近 PasswordHistory 次用过的密码
+func (user *User) checkPasswordReused(rawPassword string) error {
+	if user.mgr.config.PasswordHistory <= 0 {
+		return nil
+	}
+
+	var current string
+	query := fmt.Sprintf("SELECT password FROM %v WHERE id = ?;", user.mgr.tableUser.Name)
+	args := []interface{}{user.ID}
+	if err := user.mgr.db.QueryRow(query, args...).Scan(&current); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	queryHistory := fmt.Sprintf("SELECT password FROM %v WHERE uid = ? ORDER BY id DESC LIMIT ?;", user.mgr.tablePasswordHist.Name)
+	argsHistory := []interface{}{user.UID, user.mgr.config.PasswordHistory}
+	rows, err := user.mgr.db.Query(queryHistory, argsHistory...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	passwords := []string{current}
+	for rows.Next() {
+		var password string
+		if err = rows.Scan(&password); err != nil {
+			return err
+		}
+		if password != current {
+			passwords = append(passwords, password)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, password := range passwords {
+		ok, _, err := user.mgr.matchPassword(password, rawPassword)
+		if err != nil {
+			mlogger.WarnN(user.mgr.mlogname, "checkPasswordReused %v err: %v", user.UID, err)
+			continue
+		}
+		if ok {
+			return ErrorPasswordReused
+		}
+	}
+	return nil
+}
+
+// checkPasswordExpired 密码是否超过 PasswordMaxAge 未修改 从未修改过的按注册时间计算
+func (mgr *UserMgr) checkPasswordExpired(id int) error {
+	if mgr.config.PasswordMaxAge <= 0 {
+		return nil
+	}
+
+	var changed sql.NullTime
+	var created time.Time
+	query := fmt.Sprintf("SELECT password_changed, created FROM %v WHERE id = ?;", mgr.tableUser.Name)
+	args := []interface{}{id}
+	if err := mgr.db.QueryRow(query, args...).Scan(&changed, &created); err == sql.ErrNoRows {
+		return ErrorNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if changed.Valid {
+		created = changed.Time
+	}
+	if time.Now().After(created.Add(time.Duration(mgr.config.PasswordMaxAge) * time.Second)) {
+		return ErrorPasswordExpired
+	}
+	return nil
+}
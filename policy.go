@@ -0,0 +1,163 @@
+// Package gouser 密码强度策略
+package gouser
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	mlogger "github.com/cheetah-fun-gs/goplus/multier/multilogger"
+	"github.com/cheetah-fun-gs/gouser/breach"
+)
+
+// 密码规则 用于 PasswordPolicyError
+const (
+	PasswordRuleMinLength = "min_length" // 长度不足
+	PasswordRuleMaxLength = "max_length" // 长度超出
+	PasswordRuleUpper     = "upper"      // 缺少大写字母
+	PasswordRuleLower     = "lower"      // 缺少小写字母
+	PasswordRuleDigit     = "digit"      // 缺少数字
+	PasswordRuleSymbol    = "symbol"     // 缺少特殊字符
+	PasswordRuleClasses   = "classes"    // 字符种类不足
+	PasswordRuleIdentity  = "identity"   // 包含uid/邮箱/手机号
+	PasswordRuleBreached  = "breached"   // 出现在已泄露的密码库中
+)
+
+// PasswordPolicy 密码强度策略
+type PasswordPolicy struct {
+	MinLength        int            // 最小长度 按字符计
+	MaxLength        int            // 最大长度 按字符计 为0不限制
+	RequireUpper     bool           // 必须包含大写字母
+	RequireLower     bool           // 必须包含小写字母
+	RequireDigit     bool           // 必须包含数字
+	RequireSymbol    bool           // 必须包含特殊字符
+	MinClasses       int            // 至少包含几类字符(大写、小写、数字、特殊字符)
+	DisallowIdentity bool           // 不允许包含uid、邮箱(@前部分)、手机号 忽略大小写
+	BreachChecker    breach.Checker // 泄露密码检查 为nil不检查
+	IsBreachFailOpen bool           // 泄露密码检查出错时是否放行
+}
+
+// PasswordPolicyError 密码不符合策略 Rules 为未通过的规则
+// errors.Is(err, ErrorPasswordWeak) 为 true
+type PasswordPolicyError struct {
+	Rules []string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return ErrorPasswordWeak.Error() + ": " + strings.Join(e.Rules, ",")
+}
+
+// Unwrap ...
+func (e *PasswordPolicyError) Unwrap() error {
+	return ErrorPasswordWeak
+}
+
+// Has 是否包含某条规则
+func (e *PasswordPolicyError) Has(rule string) bool {
+	for _, r := range e.Rules {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// SetPasswordPolicy 设置密码强度策略 为nil表示不校验
+func (mgr *UserMgr) SetPasswordPolicy(policy *PasswordPolicy) {
+	mgr.passwordPolicy = policy
+}
+
+// ValidatePassword 按密码强度策略校验密码 identities 为用户的uid/邮箱/手机号, 用于 DisallowIdentity
+// 不通过时返回 *PasswordPolicyError
+func (mgr *UserMgr) ValidatePassword(rawPassword string, identities ...string) error {
+	policy := mgr.passwordPolicy
+	if policy == nil {
+		return nil
+	}
+
+	rules := []string{}
+	length := utf8.RuneCountInString(rawPassword)
+	if length < policy.MinLength || length == 0 {
+		rules = append(rules, PasswordRuleMinLength)
+	}
+	if policy.MaxLength > 0 && length > policy.MaxLength {
+		rules = append(rules, PasswordRuleMaxLength)
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range rawPassword {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		default:
+			hasSymbol = true
+		}
+	}
+	if policy.RequireUpper && !hasUpper {
+		rules = append(rules, PasswordRuleUpper)
+	}
+	if policy.RequireLower && !hasLower {
+		rules = append(rules, PasswordRuleLower)
+	}
+	if policy.RequireDigit && !hasDigit {
+		rules = append(rules, PasswordRuleDigit)
+	}
+	if policy.RequireSymbol && !hasSymbol {
+		rules = append(rules, PasswordRuleSymbol)
+	}
+	if policy.MinClasses > 0 {
+		classes := 0
+		for _, has := range []bool{hasUpper, hasLower, hasDigit, hasSymbol} {
+			if has {
+				classes++
+			}
+		}
+		if classes < policy.MinClasses {
+			rules = append(rules, PasswordRuleClasses)
+		}
+	}
+
+	if policy.DisallowIdentity {
+		lower := strings.ToLower(rawPassword)
+		for _, identity := range identities {
+			if i := strings.Index(identity, "@"); i > 0 {
+				identity = identity[:i]
+			}
+			identity = strings.ToLower(identity)
+			if len(identity) >= 3 && strings.Contains(lower, identity) {
+				rules = append(rules, PasswordRuleIdentity)
+				break
+			}
+		}
+	}
+
+	// 其他规则不通过时不再查询泄露库
+	if len(rules) == 0 && policy.BreachChecker != nil {
+		breached, err := policy.BreachChecker.IsBreached(rawPassword)
+		if err != nil {
+			if !policy.IsBreachFailOpen {
+				return err
+			}
+			mlogger.WarnN(mgr.mlogname, "BreachChecker.IsBreached err: %v", err)
+		} else if breached {
+			rules = append(rules, PasswordRuleBreached)
+		}
+	}
+
+	if len(rules) > 0 {
+		return &PasswordPolicyError{Rules: rules}
+	}
+	return nil
+}
+
+// validatePassword 校验用户的新密码 强度策略和历史密码
+func (user *User) validatePassword(rawPassword string) error {
+	if err := user.mgr.ValidatePassword(rawPassword, user.UID, user.Email, user.Mobile); err != nil {
+		return err
+	}
+	return user.checkPasswordReused(rawPassword)
+}
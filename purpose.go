@@ -0,0 +1,109 @@
+// Package gouser 验证码用途 不同用途的验证码互不通用
+package gouser
+
+import (
+	"crypto/rand"
+	"math/big"
+
+	"github.com/cheetah-fun-gs/goplus/locker"
+)
+
+// CodePurpose 验证码用途 作为场景的一部分写入key
+type CodePurpose string
+
+// 验证码用途
+const (
+	CodePurposeRegisterEmail  CodePurpose = "register_email"  // 邮箱注册
+	CodePurposeRegisterMobile CodePurpose = "register_mobile" // 手机注册
+	CodePurposeLoginEmail     CodePurpose = "login_email"     // 邮箱登录
+	CodePurposeLoginMobile    CodePurpose = "login_mobile"    // 手机登录
+	CodePurposeChangeEmail    CodePurpose = "change_email"    // 更新邮箱
+	CodePurposeChangeMobile   CodePurpose = "change_mobile"   // 更新手机号
+	CodePurposeChangePassword CodePurpose = "change_password" // 更改密码
+	CodePurposeResetPassword  CodePurpose = "reset_password"  // 重置密码
+)
+
+// CodeSetting 按用途的验证码配置 为0或空的字段使用默认值
+type CodeSetting struct {
+	Expire   int    // 过期时间 默认 CodeExpire
+	Length   int    // 长度 与 Alphabet 任一设置时按字母表随机生成, 否则使用 SetGenerateCode 的方法
+	Alphabet string // 字母表 默认 0-9
+}
+
+const defaultCodeAlphabet = "0123456789"
+
+// getCodeSetting 获得用途的验证码配置
+func (mgr *UserMgr) getCodeSetting(purpose CodePurpose) *CodeSetting {
+	setting := &CodeSetting{}
+	if s, ok := mgr.config.CodeSettings[purpose]; ok && s != nil {
+		*setting = *s
+	}
+	if setting.Expire == 0 {
+		setting.Expire = mgr.config.CodeExpire
+	}
+	return setting
+}
+
+// generatePurposeCode 按用途的配置生成验证码
+func (mgr *UserMgr) generatePurposeCode(setting *CodeSetting) (string, error) {
+	if setting.Length == 0 && setting.Alphabet == "" {
+		return mgr.generateCode(), nil
+	}
+
+	length := setting.Length
+	if length == 0 {
+		length = 6
+	}
+	alphabet := []rune(setting.Alphabet)
+	if len(alphabet) == 0 {
+		alphabet = []rune(defaultCodeAlphabet)
+	}
+
+	max := big.NewInt(int64(len(alphabet)))
+	code := make([]rune, length)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = alphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// applyPurposeCode 按用途申请验证码 lockname 不为空时防重放
+func (mgr *UserMgr) applyPurposeCode(purpose CodePurpose, lockname string, targets ...interface{}) (code string, expire, retry int, err error) {
+	setting := mgr.getCodeSetting(purpose)
+	expire = setting.Expire
+	args := append([]interface{}{purpose}, targets...)
+
+	conn := mgr.pool.Get()
+	defer conn.Close()
+
+	if lockname != "" {
+		retry = mgr.config.CodeRetry
+		if err = locker.Lock(conn, getCodeLockKey(mgr.name, lockname), retry); err == locker.ErrorLocked {
+			err = ErrorLocked
+			return
+		} else if err != nil {
+			return
+		}
+	}
+
+	if code, err = mgr.generatePurposeCode(setting); err != nil {
+		return
+	}
+	err = mgr.saveCode(conn, code, expire, args...)
+	return
+}
+
+// verifyPurposeCode 按用途校验验证码 失败次数按用途计入 account, 同时计入 ip
+func (mgr *UserMgr) verifyPurposeCode(account, ip, code string, purpose CodePurpose, targets ...interface{}) (bool, error) {
+	return mgr.verifyPurposeCodeBefore(account, ip, code, purpose, nil, targets...)
+}
+
+// verifyPurposeCodeBefore 按用途校验验证码 验证码正确时先执行 before, 见 verifyCodeBefore
+func (mgr *UserMgr) verifyPurposeCodeBefore(account, ip, code string, purpose CodePurpose, before func() error, targets ...interface{}) (bool, error) {
+	return mgr.verifyCodeBefore(getCodeLockAccount(string(purpose), account), ip, code, mgr.getCodeSetting(purpose).Expire,
+		before, append([]interface{}{purpose}, targets...)...)
+}
@@ -0,0 +1,158 @@
+// Package gouser 验证码申请限流 滑动窗口 按目标、IP、设备和全局分别限制
+package gouser
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	uuidplus "github.com/cheetah-fun-gs/goplus/uuid"
+	"github.com/cheetah-fun-gs/gouser/tokenmgr"
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+// 限流范围 用于 RateLimitError
+const (
+	RateLimitScopeTarget = "target" // 同一目标 手机号/邮箱/用户
+	RateLimitScopeIP     = "ip"     // 同一客户端IP
+	RateLimitScopeDevice = "device" // 同一设备
+	RateLimitScopeGlobal = "global" // 全局
+)
+
+// RateLimit 滑动窗口限流 Window 秒内最多 Limit 次
+type RateLimit struct {
+	Limit  int // 次数
+	Window int // 窗口 秒
+}
+
+// RateLimitError 验证码申请被限流 RetryAfter 秒后可重试
+// errors.Is(err, ErrorRateLimited) 为 true
+type RateLimitError struct {
+	Scope      string `json:"scope,omitempty"`
+	Limit      int    `json:"limit,omitempty"`
+	Window     int    `json:"window,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%v: %v %v times in %v seconds, retry after %v seconds",
+		ErrorRateLimited.Error(), e.Scope, e.Limit, e.Window, e.RetryAfter)
+}
+
+// Unwrap ...
+func (e *RateLimitError) Unwrap() error {
+	return ErrorRateLimited
+}
+
+type rateLimitRule struct {
+	scope string
+	key   string
+	limit *RateLimit
+}
+
+func getRateLimitKey(name, scope, value string, window int) string {
+	if value == "" {
+		return fmt.Sprintf("%s:ratelimit:code:%s:%d", name, scope, window)
+	}
+	return fmt.Sprintf("%s:ratelimit:code:%s:%s:%d", name, scope, value, window)
+}
+
+// 检查所有窗口 全部未超限时才计入一次
+// KEYS: 各窗口的有序集合
+// ARGV[1]: 当前时间(毫秒) ARGV[2]: 本次记录的唯一成员 ARGV[2i+1]: 第i个窗口的次数 ARGV[2i+2]: 第i个窗口的时长(毫秒)
+// 返回 {0, 0} 通过; {i, 毫秒} 第i个窗口超限及剩余时间
+var rateLimitScript = redigo.NewScript(-1, `local now = tonumber(ARGV[1])
+	for i, key in ipairs(KEYS) do
+		local limit = tonumber(ARGV[2 * i + 1])
+		local window = tonumber(ARGV[2 * i + 2])
+		redis.call("ZREMRANGEBYSCORE", key, "-inf", now - window)
+		if redis.call("ZCARD", key) >= limit
+		then
+			local oldest = redis.call("ZRANGE", key, 0, 0, "WITHSCORES")
+			return {i, tonumber(oldest[2]) + window - now}
+		end
+	end
+	for i, key in ipairs(KEYS) do
+		redis.call("ZADD", key, now, ARGV[2])
+		redis.call("PEXPIRE", key, tonumber(ARGV[2 * i + 2]))
+	end
+	return {0, 0}`)
+
+// CheckCodeRateLimit 检查验证码申请频率 未超限时计入一次, 超限时返回 *RateLimitError
+// target 为接收验证码的手机号/邮箱或用户uid, IP和设备取自 metas; 所有 *ApplyCode 方法已调用, 自定义场景使用 ApplyCode 时需自行调用
+func (mgr *UserMgr) CheckCodeRateLimit(target string, metas ...*tokenmgr.SessionMeta) error {
+	return mgr.checkCodeRateLimit([]string{target}, metas...)
+}
+
+// checkCodeRateLimit 同时按多个目标限流 如用户uid和接收验证码的邮箱, 任一超限都不计入
+func (mgr *UserMgr) checkCodeRateLimit(targets []string, metas ...*tokenmgr.SessionMeta) error {
+	meta := tokenmgr.GetMeta(metas...)
+
+	type scope struct {
+		name   string
+		value  string
+		limits []*RateLimit
+	}
+	scopes := []*scope{}
+	values := map[string]bool{}
+	for _, target := range targets {
+		value := strings.ToLower(target)
+		if !values[value] {
+			values[value] = true
+			scopes = append(scopes, &scope{RateLimitScopeTarget, value, mgr.config.CodeLimitTarget})
+		}
+	}
+	scopes = append(scopes,
+		&scope{RateLimitScopeIP, meta.IP, mgr.config.CodeLimitIP},
+		&scope{RateLimitScopeDevice, meta.Device, mgr.config.CodeLimitDevice},
+		&scope{RateLimitScopeGlobal, "", mgr.config.CodeLimitGlobal},
+	)
+
+	rules := []*rateLimitRule{}
+	for _, scope := range scopes {
+		if scope.name != RateLimitScopeGlobal && scope.value == "" {
+			continue
+		}
+		for _, limit := range scope.limits {
+			if limit == nil || limit.Limit <= 0 || limit.Window <= 0 {
+				continue
+			}
+			rules = append(rules, &rateLimitRule{
+				scope: scope.name,
+				key:   getRateLimitKey(mgr.name, scope.name, scope.value, limit.Window),
+				limit: limit,
+			})
+		}
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	args := []interface{}{len(rules)}
+	for _, rule := range rules {
+		args = append(args, rule.key)
+	}
+	args = append(args, time.Now().UnixNano()/int64(time.Millisecond), uuidplus.NewV4().Base62())
+	for _, rule := range rules {
+		args = append(args, rule.limit.Limit, rule.limit.Window*1000)
+	}
+
+	conn := mgr.pool.Get()
+	defer conn.Close()
+
+	result, err := redigo.Ints(rateLimitScript.Do(conn, args...))
+	if err != nil {
+		return err
+	}
+	if result[0] == 0 {
+		return nil
+	}
+
+	rule := rules[result[0]-1]
+	return &RateLimitError{
+		Scope:      rule.scope,
+		Limit:      rule.limit.Limit,
+		Window:     rule.limit.Window,
+		RetryAfter: (result[1] + 999) / 1000,
+	}
+}
@@ -0,0 +1,144 @@
+// Package gouser 多因素认证恢复码
+package gouser
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	sqlplus "github.com/cheetah-fun-gs/goplus/dao/sql"
+	mlogger "github.com/cheetah-fun-gs/goplus/multier/multilogger"
+)
+
+// 恢复码字符集 去掉了易混淆的 0 1 I O
+const recoveryCodeAlphabet = "23456789ABCDEFGHJKLMNPQRSTUVWXYZ"
+
+// 恢复码长度 显示时每5位用-分隔
+const recoveryCodeLength = 10
+
+func generateRecoveryCode() (string, error) {
+	buf := make([]byte, recoveryCodeLength)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	code := make([]byte, 0, recoveryCodeLength+1)
+	for i, b := range buf {
+		if i == recoveryCodeLength/2 {
+			code = append(code, '-')
+		}
+		code = append(code, recoveryCodeAlphabet[int(b)%len(recoveryCodeAlphabet)])
+	}
+	return string(code), nil
+}
+
+// normalizeRecoveryCode 忽略大小写、空格和分隔符
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.Replace(code, "-", "", -1)
+	code = strings.Replace(code, " ", "", -1)
+	return code
+}
+
+func (mgr *UserMgr) getRecoveryCodeHash(uid, code string) string {
+	h := hmac.New(sha256.New, []byte(mgr.secret))
+	h.Write([]byte(uid))
+	h.Write([]byte(":"))
+	h.Write([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// CompleteMFAWithRecoveryCode 使用恢复码完成二次验证并登录 恢复码使用后失效
+// 挑战来自密码登录且密码已过期时, 与 CompleteMFA 相同返回 user 和 ErrorPasswordExpired
+func (mgr *UserMgr) CompleteMFAWithRecoveryCode(challengeID, code string) (user *User, token string, deadline int64, err error) {
+	return mgr.completeMFA(challengeID, func(user *User) (bool, error) {
+		return user.VerifyRecoveryCode(code)
+	})
+}
+
+// GenerateRecoveryCodes 生成一批恢复码 之前生成的恢复码全部失效
+// 恢复码只保存哈希, 仅在此时返回明文, 需提示用户妥善保存
+func (user *User) GenerateRecoveryCodes() (codes []string, err error) {
+	if !user.mgr.config.IsEnableMFA {
+		return nil, fmt.Errorf("IsEnableMFA is not enable")
+	}
+
+	now := time.Now()
+	datas := []*ModelUserRecoveryCode{}
+	for len(codes) < user.mgr.config.MFARecoveryCodes {
+		var code string
+		if code, err = generateRecoveryCode(); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+		datas = append(datas, &ModelUserRecoveryCode{
+			UID:      user.UID,
+			CodeHash: user.mgr.getRecoveryCodeHash(user.UID, code),
+			Created:  now,
+		})
+	}
+
+	// 使用事务
+	var tx *sql.Tx
+	tx, err = user.mgr.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			if errRollback := tx.Rollback(); errRollback != nil {
+				mlogger.WarnN(user.mgr.mlogname, "GenerateRecoveryCodes Rollback %v err: %v", user.UID, errRollback)
+			}
+		}
+	}()
+
+	query := fmt.Sprintf("DELETE FROM %v WHERE uid = ?;", user.mgr.tableRecoveryCode.Name)
+	args := []interface{}{user.UID}
+	if _, err = tx.Exec(query, args...); err != nil {
+		return nil, err
+	}
+
+	for _, data := range datas {
+		queryInsert, argsInsert := sqlplus.GenInsert(user.mgr.tableRecoveryCode.Name, data)
+		if _, err = tx.Exec(queryInsert, argsInsert...); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// CountRecoveryCodes 剩余可用的恢复码数量
+func (user *User) CountRecoveryCodes() (int, error) {
+	query := fmt.Sprintf("SELECT COUNT(*) FROM %v WHERE uid = ?;", user.mgr.tableRecoveryCode.Name)
+	args := []interface{}{user.UID}
+
+	var count int
+	if err := user.mgr.db.QueryRow(query, args...).Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// VerifyRecoveryCode 校验恢复码 通过后该恢复码立即失效
+func (user *User) VerifyRecoveryCode(code string) (bool, error) {
+	if len(normalizeRecoveryCode(code)) != recoveryCodeLength {
+		return false, nil
+	}
+
+	query := fmt.Sprintf("DELETE FROM %v WHERE uid = ? AND code_hash = ?;", user.mgr.tableRecoveryCode.Name)
+	args := []interface{}{user.UID, user.mgr.getRecoveryCodeHash(user.UID, code)}
+	n, err := sqlplus.RowsAffected(user.mgr.db.Exec(query, args...))
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
@@ -3,27 +3,38 @@ package gouser
 
 import (
 	"database/sql"
-	"fmt"
 	"time"
 
 	sqlplus "github.com/cheetah-fun-gs/goplus/dao/sql"
 	mlogger "github.com/cheetah-fun-gs/goplus/multier/multilogger"
+	"github.com/cheetah-fun-gs/gouser/codesender"
+	"github.com/cheetah-fun-gs/gouser/tokenmgr"
 )
 
-// RegisterLAPD 密码用户注册
+// RegisterLAPD 密码用户注册 密码不符合强度策略时返回 *PasswordPolicyError
 func (mgr *UserMgr) RegisterLAPD(uid, rawPassword string) (*User, error) {
+	if err := mgr.ValidatePassword(rawPassword, uid); err != nil {
+		return nil, err
+	}
+
+	password, err := mgr.getPassword(rawPassword)
+	if err != nil {
+		return nil, err
+	}
+
 	now := time.Now()
 	_, nickname, avatar, extra := mgr.generateUID()
 
 	data := &ModelUser{
-		UID:       uid,
-		Password:  mgr.getPassword(rawPassword),
-		Nickname:  nickname,
-		Avatar:    avatar,
-		Extra:     extra,
-		LastLogin: now,
-		Created:   now,
-		Updated:   now,
+		UID:             uid,
+		Password:        password,
+		PasswordChanged: sql.NullTime{Valid: true, Time: now},
+		Nickname:        nickname,
+		Avatar:          avatar,
+		Extra:           extra,
+		LastLogin:       now,
+		Created:         now,
+		Updated:         now,
 	}
 
 	query, args := sqlplus.GenInsert(mgr.tableUser.Name, data)
@@ -32,6 +43,10 @@ func (mgr *UserMgr) RegisterLAPD(uid, rawPassword string) (*User, error) {
 		return nil, err
 	}
 
+	if errHistory := mgr.addPasswordHistory(uid, password, now); errHistory != nil {
+		mlogger.WarnN(mgr.mlogname, "addPasswordHistory %v err: %v", uid, errHistory)
+	}
+
 	return &User{
 		mgr: mgr,
 		UserData: &UserData{
@@ -45,21 +60,39 @@ func (mgr *UserMgr) RegisterLAPD(uid, rawPassword string) (*User, error) {
 	}, nil
 }
 
-// RegisterEmailApplyCode 邮件用户注册申请code
-func (mgr *UserMgr) RegisterEmailApplyCode(email string) (code string, expire int, err error) {
-	return mgr.ApplyCode(0, email)
+// RegisterEmailApplyCode 邮件用户注册申请code 超过限流返回 *RateLimitError
+func (mgr *UserMgr) RegisterEmailApplyCode(email string, metas ...*tokenmgr.SessionMeta) (code string, expire int, err error) {
+	if err = mgr.CheckCodeRateLimit(email, metas...); err != nil {
+		return
+	}
+	code, expire, _, err = mgr.applyPurposeCode(CodePurposeRegisterEmail, "", email)
+	return
+}
+
+// RegisterEmailSendCode 邮件用户注册申请code 并直接发送到邮箱
+func (mgr *UserMgr) RegisterEmailSendCode(email string, meta *tokenmgr.SessionMeta, locales ...string) (expire int, err error) {
+	var code string
+	if code, expire, err = mgr.RegisterEmailApplyCode(email, meta); err != nil {
+		return
+	}
+	err = mgr.sendCode(codesender.ChannelEmail, email, CodeTemplateRegisterEmail, code, expire, locales...)
+	return
 }
 
 // RegisterEmail 邮件用户注册
 func (mgr *UserMgr) RegisterEmail(email, code string) (*User, error) {
-	ok, err := mgr.VerifyCode(code, email)
+	ok, err := mgr.verifyPurposeCode(email, "", code, CodePurposeRegisterEmail, email)
 	if err != nil {
 		return nil, err
 	}
 	if !ok {
-		return nil, fmt.Errorf("code is invalid")
+		return nil, ErrorCodeInvalid
 	}
 
+	return mgr.registerEmail(email)
+}
+
+func (mgr *UserMgr) registerEmail(email string) (*User, error) {
 	now := time.Now()
 	uid, nickname, avatar, extra := mgr.generateUID()
 	data := &ModelUser{
@@ -93,19 +126,32 @@ func (mgr *UserMgr) RegisterEmail(email, code string) (*User, error) {
 	}, nil
 }
 
-// RegisterMobileApplyCode 手机用户注册申请code
-func (mgr *UserMgr) RegisterMobileApplyCode(mobile string) (code string, expire, retry int, err error) {
-	return mgr.ApplyCodeAntiReplay(mobile, 0, 0, mobile)
+// RegisterMobileApplyCode 手机用户注册申请code 超过限流返回 *RateLimitError
+func (mgr *UserMgr) RegisterMobileApplyCode(mobile string, metas ...*tokenmgr.SessionMeta) (code string, expire, retry int, err error) {
+	if err = mgr.CheckCodeRateLimit(mobile, metas...); err != nil {
+		return
+	}
+	return mgr.applyPurposeCode(CodePurposeRegisterMobile, mobile, mobile)
+}
+
+// RegisterMobileSendCode 手机用户注册申请code 并直接发送到手机
+func (mgr *UserMgr) RegisterMobileSendCode(mobile string, meta *tokenmgr.SessionMeta, locales ...string) (expire, retry int, err error) {
+	var code string
+	if code, expire, retry, err = mgr.RegisterMobileApplyCode(mobile, meta); err != nil {
+		return
+	}
+	err = mgr.sendCode(codesender.ChannelSMS, mobile, CodeTemplateRegisterMobile, code, expire, locales...)
+	return
 }
 
 // RegisterMobile 手机用户注册
 func (mgr *UserMgr) RegisterMobile(mobile, code string) (*User, error) {
-	ok, err := mgr.VerifyCode(code, mobile)
+	ok, err := mgr.verifyPurposeCode(mobile, "", code, CodePurposeRegisterMobile, mobile)
 	if err != nil {
 		return nil, err
 	}
 	if !ok {
-		return nil, fmt.Errorf("code is invalid")
+		return nil, ErrorCodeInvalid
 	}
 
 	return mgr.registerMobile(mobile)
@@ -0,0 +1,95 @@
+// Package gouser 忘记密码 重置密码
+package gouser
+
+import (
+	"github.com/cheetah-fun-gs/goplus/locker"
+	mlogger "github.com/cheetah-fun-gs/goplus/multier/multilogger"
+	"github.com/cheetah-fun-gs/gouser/codesender"
+	"github.com/cheetah-fun-gs/gouser/tokenmgr"
+)
+
+// ResetPasswordApplyCode 忘记密码 申请重置验证码并发送到用户邮箱, 没有邮箱时发送到手机
+// identifier 可以是uid/邮箱/手机号, 验证码与 identifier 绑定; 为了不泄露账号是否存在, 账号不存在或无法发送时同样返回成功
+// 限流按 identifier 计算, 超过限流返回 *RateLimitError
+func (mgr *UserMgr) ResetPasswordApplyCode(identifier string, meta *tokenmgr.SessionMeta, locales ...string) (expire, retry int, err error) {
+	expire = mgr.getCodeSetting(CodePurposeResetPassword).Expire
+	retry = mgr.config.CodeRetry
+
+	if err = mgr.CheckCodeRateLimit(identifier, meta); err != nil {
+		return
+	}
+
+	conn := mgr.pool.Get()
+	defer conn.Close()
+
+	// 按输入限频 与账号是否存在无关
+	if err = locker.Lock(conn, getCodeLockKey(mgr.name, string(CodePurposeResetPassword)+":"+identifier), retry); err == locker.ErrorLocked {
+		err = ErrorLocked
+		return
+	} else if err != nil {
+		return
+	}
+
+	var ok bool
+	var user *User
+	if ok, user, err = mgr.FindUserByAny(identifier); err != nil {
+		return
+	} else if !ok {
+		return
+	}
+
+	var channel, to string
+	if user.Email != "" {
+		channel, to = codesender.ChannelEmail, user.Email
+	} else if user.Mobile != "" {
+		channel, to = codesender.ChannelSMS, user.Mobile
+	} else {
+		return
+	}
+
+	var code string
+	if code, _, _, err = mgr.applyPurposeCode(CodePurposeResetPassword, "", identifier); err != nil {
+		mlogger.WarnN(mgr.mlogname, "ResetPasswordApplyCode ApplyCode %v err: %v", user.UID, err)
+		err = nil
+		return
+	}
+
+	if errSend := mgr.sendCode(channel, to, CodeTemplateResetPassword, code, expire, locales...); errSend != nil {
+		mlogger.WarnN(mgr.mlogname, "ResetPasswordApplyCode sendCode %v err: %v", user.UID, errSend)
+	}
+	return
+}
+
+// ResetPassword 忘记密码 使用验证码重置密码 identifier和申请时保持一致
+// 先校验验证码, 验证码正确后才校验新密码的强度和历史密码; 账号不存在和验证码错误都返回 ErrorCodeInvalid
+// 重置成功后该用户所有的token和刷新令牌全部失效
+func (mgr *UserMgr) ResetPassword(identifier, code, newRawPassword string) error {
+	found, user, err := mgr.FindUserByAny(identifier)
+	if err != nil {
+		return err
+	}
+
+	// 账号不存在时没有验证码, 与验证码错误走同样的流程
+	validate := func() error {
+		if !found {
+			return ErrorCodeInvalid
+		}
+		return user.validatePassword(newRawPassword)
+	}
+	ok, err := mgr.verifyPurposeCodeBefore(identifier, "", code, CodePurposeResetPassword, validate, identifier)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrorCodeInvalid
+	}
+
+	if err = user.setPassword(newRawPassword); err != nil {
+		return err
+	}
+
+	if err = mgr.tokenmgr.CleanAll(user.UID); err != nil {
+		return err
+	}
+	return mgr.refreshmgr.RevokeAll(user.UID)
+}
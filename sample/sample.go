@@ -107,7 +107,7 @@ func main() {
 	// 修改email
 	time.Sleep(200 * time.Millisecond)
 	testemail := "test123@123.com"
-	emailcode, _, err := user.UpdateEmailApplyCode()
+	emailcode, _, err := user.UpdateEmailApplyCode(testemail)
 	if err != nil {
 		panic(err)
 	}
@@ -154,7 +154,7 @@ func main() {
 
 	ts := time.Now().Unix()
 	sign := defaultGenerateSign(accessKey.AccessKey, ts)
-	ok, err = mgr.VerifySign(user.UID, accessKey.ID, ts, sign)
+	ok, _, err = mgr.VerifySign(user.UID, accessKey.ID, ts, sign)
 	if err != nil {
 		panic(err)
 	}
@@ -218,7 +218,7 @@ func main() {
 	if err = user.UpdatePasswordWithCode(testpassword, passwardcode); err != nil {
 		panic(err)
 	}
-	if _, _, _, err = mgr.LoginLAPD(testuid, testpassword); err != nil {
+	if _, _, _, err = mgr.LoginLAPD(lapdUID, testpassword); err != nil {
 		panic(err)
 	}
 
@@ -0,0 +1,93 @@
+// Package gouser 敏感数据加密存储 使用主密钥派生的 AES-GCM 密钥
+package gouser
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// 加密存储的数据前缀 格式 enc:主密钥ID:base64(nonce+密文)
+const sealedPrefix = "enc:"
+
+// 加密用途 不同用途使用不同的派生密钥
+const (
+	sealLabelAccessKey = "gouser:access_key"
+	sealLabelTOTP      = "gouser:totp"
+)
+
+// sealCipher 由主密钥派生指定用途的加密密钥
+func sealCipher(masterKey []byte, label string) (cipher.AEAD, error) {
+	h := hmac.New(sha256.New, masterKey)
+	h.Write([]byte(label))
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal 使用当前主密钥加密 密文与 aad 绑定, 解密时必须提供相同的 aad
+func (mgr *UserMgr) seal(label, aad, plain string) (string, error) {
+	masterKeyID, masterKey, err := mgr.keyProvider.Current()
+	if err != nil {
+		return "", err
+	}
+	aead, err := sealCipher(masterKey, label)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plain), []byte(aad))
+	return sealedPrefix + masterKeyID + ":" + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// open 解密 未加密的旧数据原样返回
+// isCurrent 是否已使用当前主密钥加密, 为false时需要迁移
+func (mgr *UserMgr) open(label, aad, stored string) (plain string, isCurrent bool, err error) {
+	if !strings.HasPrefix(stored, sealedPrefix) {
+		return stored, false, nil
+	}
+
+	rest := strings.TrimPrefix(stored, sealedPrefix)
+	index := strings.LastIndex(rest, ":")
+	if index < 0 {
+		return "", false, fmt.Errorf("sealed data is malformed")
+	}
+	masterKeyID := rest[:index]
+	sealed, err := base64.RawURLEncoding.DecodeString(rest[index+1:])
+	if err != nil {
+		return "", false, err
+	}
+
+	masterKey, err := mgr.keyProvider.Get(masterKeyID)
+	if err != nil {
+		return "", false, err
+	}
+	aead, err := sealCipher(masterKey, label)
+	if err != nil {
+		return "", false, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", false, fmt.Errorf("sealed data is malformed")
+	}
+	data, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(aad))
+	if err != nil {
+		return "", false, err
+	}
+
+	currentKeyID, _, err := mgr.keyProvider.Current()
+	if err != nil {
+		return "", false, err
+	}
+	return string(data), masterKeyID == currentKeyID, nil
+}
@@ -0,0 +1,128 @@
+// Package gouser 验证码发送
+package gouser
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cheetah-fun-gs/gouser/codesender"
+)
+
+// 验证码消息模板名称
+const (
+	CodeTemplateRegisterEmail  = "register_email"   // 邮箱注册
+	CodeTemplateRegisterMobile = "register_mobile"  // 手机注册
+	CodeTemplateLoginMobile    = "login_mobile"     // 手机登录
+	CodeTemplateLoginEmail     = "login_email"      // 邮箱登录
+	CodeTemplateLoginEmailLink = "login_email_link" // 邮箱登录链接
+	CodeTemplateUpdateEmail    = "update_email"     // 更新邮箱
+	CodeTemplateUpdateMobile   = "update_mobile"    // 更新手机号
+	CodeTemplateUpdatePassword = "update_password"  // 更改密码
+	CodeTemplateResetPassword  = "reset_password"   // 重置密码
+)
+
+// CodeTemplateData 验证码消息模板数据
+type CodeTemplateData struct {
+	Code    string // 验证码
+	Link    string // 登录链接 仅登录链接模板
+	Expire  int    // 有效期 秒
+	Minutes int    // 有效期 分钟
+}
+
+func defaultCodeTemplates() map[string]map[string]*codesender.Template {
+	titles := map[string][]string{
+		CodeTemplateRegisterEmail:  {"注册验证码", "Sign-up verification code"},
+		CodeTemplateRegisterMobile: {"注册验证码", "Sign-up verification code"},
+		CodeTemplateLoginMobile:    {"登录验证码", "Sign-in verification code"},
+		CodeTemplateLoginEmail:     {"登录验证码", "Sign-in verification code"},
+		CodeTemplateUpdateEmail:    {"更换邮箱验证码", "Email change verification code"},
+		CodeTemplateUpdateMobile:   {"更换手机号验证码", "Mobile change verification code"},
+		CodeTemplateUpdatePassword: {"修改密码验证码", "Password change verification code"},
+		CodeTemplateResetPassword:  {"重置密码验证码", "Password reset verification code"},
+	}
+
+	templates := map[string]map[string]*codesender.Template{}
+	for name, title := range titles {
+		templates[name] = map[string]*codesender.Template{
+			"": codesender.MustNewTemplate(title[0],
+				fmt.Sprintf("%s: {{.Code}}, {{.Minutes}}分钟内有效, 请勿泄露给他人。", title[0])),
+			"en": codesender.MustNewTemplate(title[1],
+				fmt.Sprintf("%s: {{.Code}}. It expires in {{.Minutes}} minutes. Do not share it with anyone.", title[1])),
+		}
+	}
+	templates[CodeTemplateLoginEmailLink] = map[string]*codesender.Template{
+		"": codesender.MustNewTemplate("登录链接",
+			"点击链接登录: {{.Link}} , {{.Minutes}}分钟内有效且只能使用一次, 请勿转发给他人。"),
+		"en": codesender.MustNewTemplate("Sign-in link",
+			"Click to sign in: {{.Link}} . It expires in {{.Minutes}} minutes and can be used only once. Do not forward it to anyone."),
+	}
+	return templates
+}
+
+// SetCodeSender 设置验证码发送器 同一渠道仅保留最后一个
+func (mgr *UserMgr) SetCodeSender(args ...codesender.CodeSender) {
+	for _, sender := range args {
+		mgr.codeSenders[sender.GetName()] = sender
+	}
+}
+
+// SetCodeTemplate 设置验证码消息模板 locale为空表示默认模板
+func (mgr *UserMgr) SetCodeTemplate(name, locale string, template *codesender.Template) {
+	if _, ok := mgr.codeTemplates[name]; !ok {
+		mgr.codeTemplates[name] = map[string]*codesender.Template{}
+	}
+	mgr.codeTemplates[name][strings.ToLower(locale)] = template
+}
+
+// getCodeTemplate 按 locale 选择模板: 完全匹配 > 语言匹配(zh-CN => zh) > 默认模板
+func (mgr *UserMgr) getCodeTemplate(name string, locales ...string) (*codesender.Template, error) {
+	templates, ok := mgr.codeTemplates[name]
+	if !ok {
+		return nil, fmt.Errorf("code template %v not found", name)
+	}
+
+	for _, locale := range locales {
+		locale = strings.ToLower(locale)
+		if template, ok := templates[locale]; ok {
+			return template, nil
+		}
+		if i := strings.IndexAny(locale, "-_"); i > 0 {
+			if template, ok := templates[locale[:i]]; ok {
+				return template, nil
+			}
+		}
+	}
+
+	if template, ok := templates[""]; ok {
+		return template, nil
+	}
+	return nil, fmt.Errorf("code template %v not found", name)
+}
+
+// sendCode 按模板渲染验证码消息并通过对应渠道发送
+func (mgr *UserMgr) sendCode(channel, to, templateName, code string, expire int, locales ...string) error {
+	return mgr.sendMessage(channel, to, templateName, &CodeTemplateData{
+		Code:    code,
+		Expire:  expire,
+		Minutes: (expire + 59) / 60,
+	}, locales...)
+}
+
+// sendMessage 按模板渲染消息并通过对应渠道发送
+func (mgr *UserMgr) sendMessage(channel, to, templateName string, data *CodeTemplateData, locales ...string) error {
+	sender, ok := mgr.codeSenders[channel]
+	if !ok {
+		return fmt.Errorf("code sender %v is not support", channel)
+	}
+
+	template, err := mgr.getCodeTemplate(templateName, locales...)
+	if err != nil {
+		return err
+	}
+
+	msg, err := template.Render(to, data)
+	if err != nil {
+		return err
+	}
+	return sender.Send(msg)
+}
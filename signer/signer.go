@@ -0,0 +1,268 @@
+// Package signer 请求签名 参照 AWS SigV4 的规范请求, 使用 HMAC-SHA256
+// 规范请求包括: 方法、路径、排序后的查询参数、参与签名的请求头、请求体哈希
+package signer
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	uuidplus "github.com/cheetah-fun-gs/goplus/uuid"
+)
+
+// 签名相关的常量
+const (
+	Algorithm           = "GOUSER-HMAC-SHA256" // 签名算法
+	HeaderAuthorization = "Authorization"      // 签名头
+	HeaderDate          = "X-Date"             // 签名时间 格式 TimeFormat
+	HeaderNonce         = "X-Nonce"            // 随机数 同一密钥的随机数不能重复使用
+	TimeFormat          = "20060102T150405Z"   // 签名时间格式 UTC
+	DefaultMaxBodySize  = 10 << 20             // 校验签名时请求体的默认最大字节数
+)
+
+// 必须参与签名的请求头
+var requiredHeaders = []string{"host", "x-date", "x-nonce"}
+
+// 签名错误
+var (
+	ErrorSignMissing   = fmt.Errorf("sign is missing")
+	ErrorSignMalformed = fmt.Errorf("sign is malformed")
+	ErrorSignExpired   = fmt.Errorf("sign is expired")
+	ErrorSignReplayed  = fmt.Errorf("sign is replayed")
+	ErrorBodyTooLarge  = fmt.Errorf("body is too large")
+)
+
+// Signature 解析后的签名
+type Signature struct {
+	Credential    string    // 密钥标识
+	SignedHeaders []string  // 参与签名的请求头 小写 已排序
+	Signature     string    // 签名 十六进制
+	Date          time.Time // 签名时间
+	Nonce         string    // 随机数
+}
+
+// Sign 客户端签名 设置 X-Date、X-Nonce 和 Authorization 请求头
+// headers 为额外参与签名的请求头, host、x-date、x-nonce 总是参与签名
+func Sign(r *http.Request, credential, secret string, headers ...string) error {
+	now := time.Now().UTC()
+	r.Header.Set(HeaderDate, now.Format(TimeFormat))
+	r.Header.Set(HeaderNonce, uuidplus.NewV4().Base62())
+
+	signedHeaders := normalizeHeaders(append(headers, requiredHeaders...))
+	bodyHash, err := BodyHash(r, -1)
+	if err != nil {
+		return err
+	}
+
+	canonicalRequest := CanonicalRequest(r, signedHeaders, bodyHash)
+	signature := calcSignature(secret, now, r.Header.Get(HeaderNonce), canonicalRequest)
+	r.Header.Set(HeaderAuthorization, fmt.Sprintf("%s Credential=%s, SignedHeaders=%s, Signature=%s",
+		Algorithm, credential, strings.Join(signedHeaders, ";"), signature))
+	return nil
+}
+
+// Parse 服务端解析签名 不校验签名是否正确
+func Parse(r *http.Request) (*Signature, error) {
+	authorization := r.Header.Get(HeaderAuthorization)
+	if authorization == "" {
+		return nil, ErrorSignMissing
+	}
+	if !strings.HasPrefix(authorization, Algorithm+" ") {
+		return nil, ErrorSignMalformed
+	}
+
+	signature := &Signature{}
+	for _, part := range strings.Split(strings.TrimPrefix(authorization, Algorithm+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return nil, ErrorSignMalformed
+		}
+		switch kv[0] {
+		case "Credential":
+			signature.Credential = kv[1]
+		case "SignedHeaders":
+			signature.SignedHeaders = strings.Split(kv[1], ";")
+		case "Signature":
+			signature.Signature = kv[1]
+		}
+	}
+	if signature.Credential == "" || signature.Signature == "" {
+		return nil, ErrorSignMalformed
+	}
+
+	signature.SignedHeaders = normalizeHeaders(signature.SignedHeaders)
+	for _, header := range requiredHeaders {
+		if !containsString(signature.SignedHeaders, header) {
+			return nil, ErrorSignMalformed
+		}
+	}
+
+	date, err := time.Parse(TimeFormat, r.Header.Get(HeaderDate))
+	if err != nil {
+		return nil, ErrorSignMalformed
+	}
+	signature.Date = date
+
+	signature.Nonce = r.Header.Get(HeaderNonce)
+	if signature.Nonce == "" {
+		return nil, ErrorSignMalformed
+	}
+	return signature, nil
+}
+
+// Verify 使用密钥校验签名 maxBodySizes 见 BodyHash
+func (s *Signature) Verify(r *http.Request, secret string, maxBodySizes ...int64) (bool, error) {
+	bodyHash, err := BodyHash(r, maxBodySizes...)
+	if err != nil {
+		return false, err
+	}
+
+	canonicalRequest := CanonicalRequest(r, s.SignedHeaders, bodyHash)
+	expected := calcSignature(secret, s.Date, s.Nonce, canonicalRequest)
+	return hmac.Equal([]byte(expected), []byte(s.Signature)), nil
+}
+
+// CheckSkew 签名时间与当前时间的误差是否在 skew 秒内
+func (s *Signature) CheckSkew(skew int) error {
+	diff := time.Since(s.Date)
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > time.Duration(skew)*time.Second {
+		return ErrorSignExpired
+	}
+	return nil
+}
+
+// BodyHash 请求体的 SHA-256 十六进制 读取后恢复请求体
+// maxBodySizes[0]: 请求体最大字节数, 默认 DefaultMaxBodySize, 小于0不限制; 超过时返回 ErrorBodyTooLarge
+func BodyHash(r *http.Request, maxBodySizes ...int64) (string, error) {
+	maxBodySize := int64(DefaultMaxBodySize)
+	if len(maxBodySizes) > 0 && maxBodySizes[0] != 0 {
+		maxBodySize = maxBodySizes[0]
+	}
+
+	var body []byte
+	if r.Body != nil {
+		var reader io.Reader = r.Body
+		if maxBodySize > 0 {
+			reader = io.LimitReader(r.Body, maxBodySize+1)
+		}
+		var err error
+		if body, err = ioutil.ReadAll(reader); err != nil {
+			return "", err
+		}
+		if maxBodySize > 0 && int64(len(body)) > maxBodySize {
+			return "", ErrorBodyTooLarge
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// CanonicalRequest 规范请求
+func CanonicalRequest(r *http.Request, signedHeaders []string, bodyHash string) string {
+	path := r.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	lines := []string{
+		r.Method,
+		path,
+		canonicalQuery(r.URL.Query()),
+	}
+	for _, header := range signedHeaders {
+		lines = append(lines, header+":"+headerValue(r, header))
+	}
+	lines = append(lines, "", strings.Join(signedHeaders, ";"), bodyHash)
+	return strings.Join(lines, "\n")
+}
+
+// StringToSign 待签名字符串
+func StringToSign(date time.Time, nonce, canonicalRequest string) string {
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	return strings.Join([]string{
+		Algorithm,
+		date.UTC().Format(TimeFormat),
+		nonce,
+		hex.EncodeToString(sum[:]),
+	}, "\n")
+}
+
+// signingKey 签名密钥 按日期(UTC)派生, 同一天内相同
+func signingKey(secret string, date time.Time) []byte {
+	return hmacSHA256([]byte("GOUSER"+secret), []byte(date.UTC().Format("20060102")))
+}
+
+// calcSignature 签名为 HMAC-SHA256(签名密钥, 待签名字符串)
+func calcSignature(secret string, date time.Time, nonce, canonicalRequest string) string {
+	return hex.EncodeToString(hmacSHA256(signingKey(secret, date), []byte(StringToSign(date, nonce, canonicalRequest))))
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func canonicalQuery(query url.Values) string {
+	pairs := []string{}
+	for key, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, escape(key)+"="+escape(value))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func escape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+func headerValue(r *http.Request, header string) string {
+	if header == "host" {
+		if r.Host != "" {
+			return r.Host
+		}
+		return r.URL.Host
+	}
+	values := []string{}
+	for _, value := range r.Header[http.CanonicalHeaderKey(header)] {
+		values = append(values, strings.TrimSpace(value))
+	}
+	return strings.Join(values, ",")
+}
+
+func normalizeHeaders(headers []string) []string {
+	result := []string{}
+	for _, header := range headers {
+		header = strings.ToLower(strings.TrimSpace(header))
+		if header != "" && !containsString(result, header) {
+			result = append(result, header)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
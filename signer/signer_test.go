@@ -0,0 +1,294 @@
+package signer
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 已知答案由独立实现(Python hashlib/hmac)按相同的规范计算
+const (
+	testSecret     = "secret-key"
+	testBody       = `{"amount":100}`
+	testBodyHash   = "4d4bbe59c6aad22442cde199a6a8a5f034405fcd78fb5a81c24ef249de1c45f1"
+	testDate       = "20240102T030405Z"
+	testNonce      = "nonce123"
+	testSigningKey = "c8a898f857dfa788152aa8cc4d3592f557a8118746f4df140595013416560310"
+	testSignature  = "653ee61d30991f275f2f00a36a1e8e2ea1edc69a43931ff2f72601e4a3473ccf"
+)
+
+var testSignedHeaders = []string{"content-type", "host", "x-date", "x-nonce"}
+
+var testCanonicalRequest = strings.Join([]string{
+	"POST",
+	"/v1/orders",
+	"limit=10&q=a%20b&status=new&status=paid",
+	"content-type:application/json",
+	"host:api.example.com",
+	"x-date:" + testDate,
+	"x-nonce:" + testNonce,
+	"",
+	"content-type;host;x-date;x-nonce",
+	testBodyHash,
+}, "\n")
+
+func newTestRequest(t *testing.T, body string) *http.Request {
+	r, err := http.NewRequest("POST", "https://api.example.com/v1/orders?status=paid&limit=10&q=a%20b&status=new", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(HeaderDate, testDate)
+	r.Header.Set(HeaderNonce, testNonce)
+	return r
+}
+
+func setAuthorization(r *http.Request, credential string, signedHeaders []string, signature string) {
+	r.Header.Set(HeaderAuthorization, fmt.Sprintf("%s Credential=%s, SignedHeaders=%s, Signature=%s",
+		Algorithm, credential, strings.Join(signedHeaders, ";"), signature))
+}
+
+func TestCanonicalRequest(t *testing.T) {
+	r := newTestRequest(t, testBody)
+	bodyHash, err := BodyHash(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bodyHash != testBodyHash {
+		t.Errorf("BodyHash = %v, want %v", bodyHash, testBodyHash)
+	}
+	if got := CanonicalRequest(r, testSignedHeaders, bodyHash); got != testCanonicalRequest {
+		t.Errorf("CanonicalRequest = %q, want %q", got, testCanonicalRequest)
+	}
+
+	// 读取后请求体恢复
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != testBody {
+		t.Errorf("body = %q, want %q", body, testBody)
+	}
+}
+
+func TestSigningKey(t *testing.T) {
+	date, _ := time.Parse(TimeFormat, testDate)
+	if got := hex.EncodeToString(signingKey(testSecret, date)); got != testSigningKey {
+		t.Errorf("signingKey = %v, want %v", got, testSigningKey)
+	}
+
+	// 按UTC日期派生 同一天内相同
+	sameDay := []time.Time{
+		time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, 1, 2, 23, 59, 59, 0, time.UTC),
+		time.Date(2024, 1, 3, 1, 0, 0, 0, time.FixedZone("UTC+8", 8*3600)),
+	}
+	for _, d := range sameDay {
+		if got := hex.EncodeToString(signingKey(testSecret, d)); got != testSigningKey {
+			t.Errorf("signingKey(%v) = %v, want %v", d, got, testSigningKey)
+		}
+	}
+
+	otherDay := []time.Time{
+		time.Date(2024, 1, 1, 23, 59, 59, 0, time.UTC),
+		time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC),
+	}
+	for _, d := range otherDay {
+		if got := hex.EncodeToString(signingKey(testSecret, d)); got == testSigningKey {
+			t.Errorf("signingKey(%v) equals the key of another day", d)
+		}
+	}
+	if got := hex.EncodeToString(signingKey("other-secret", date)); got == testSigningKey {
+		t.Error("signingKey with another secret equals the test key")
+	}
+}
+
+func TestSignatureKnownAnswer(t *testing.T) {
+	date, _ := time.Parse(TimeFormat, testDate)
+	if got := calcSignature(testSecret, date, testNonce, testCanonicalRequest); got != testSignature {
+		t.Errorf("calcSignature = %v, want %v", got, testSignature)
+	}
+
+	r := newTestRequest(t, testBody)
+	setAuthorization(r, "key-id", testSignedHeaders, testSignature)
+	signature, err := Parse(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signature.Credential != "key-id" || signature.Nonce != testNonce || !signature.Date.Equal(date) {
+		t.Errorf("Parse = %+v", signature)
+	}
+	ok, err := signature.Verify(r, testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error("Verify known answer = false, want true")
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	sign := func() *http.Request {
+		r := newTestRequest(t, testBody)
+		if err := Sign(r, "key-id", testSecret, "Content-Type"); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	verify := func(r *http.Request, secret string) bool {
+		signature, err := Parse(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, err := signature.Verify(r, secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	if r := sign(); !verify(r, testSecret) {
+		t.Error("Verify signed request = false, want true")
+	}
+	if r := sign(); verify(r, "other-secret") {
+		t.Error("Verify with another secret = true, want false")
+	}
+
+	tampers := map[string]func(r *http.Request){
+		"body": func(r *http.Request) {
+			r.Body = ioutil.NopCloser(strings.NewReader(`{"amount":999}`))
+		},
+		"signed header": func(r *http.Request) {
+			r.Header.Set("Content-Type", "text/plain")
+		},
+		"host": func(r *http.Request) {
+			r.Host = "evil.example.com"
+		},
+		"nonce": func(r *http.Request) {
+			r.Header.Set(HeaderNonce, "other-nonce")
+		},
+		"query": func(r *http.Request) {
+			r.URL.RawQuery = "limit=1000"
+		},
+		"method": func(r *http.Request) {
+			r.Method = "DELETE"
+		},
+	}
+	for name, tamper := range tampers {
+		r := sign()
+		tamper(r)
+		if verify(r, testSecret) {
+			t.Errorf("Verify with tampered %v = true, want false", name)
+		}
+	}
+
+	// 未参与签名的请求头不影响签名
+	r := sign()
+	r.Header.Set("User-Agent", "test")
+	if !verify(r, testSecret) {
+		t.Error("Verify with unsigned header changed = false, want true")
+	}
+}
+
+func TestParseRequiredHeaders(t *testing.T) {
+	for _, missing := range requiredHeaders {
+		signedHeaders := []string{}
+		for _, header := range testSignedHeaders {
+			if header != missing {
+				signedHeaders = append(signedHeaders, header)
+			}
+		}
+		r := newTestRequest(t, testBody)
+		setAuthorization(r, "key-id", signedHeaders, testSignature)
+		if _, err := Parse(r); err != ErrorSignMalformed {
+			t.Errorf("Parse without %v err = %v, want %v", missing, err, ErrorSignMalformed)
+		}
+	}
+
+	cases := map[string]struct {
+		prepare func(r *http.Request)
+		err     error
+	}{
+		"no authorization": {func(r *http.Request) { r.Header.Del(HeaderAuthorization) }, ErrorSignMissing},
+		"other algorithm":  {func(r *http.Request) { r.Header.Set(HeaderAuthorization, "AWS4-HMAC-SHA256 Credential=x") }, ErrorSignMalformed},
+		"no x-date":        {func(r *http.Request) { r.Header.Del(HeaderDate) }, ErrorSignMalformed},
+		"bad x-date":       {func(r *http.Request) { r.Header.Set(HeaderDate, "2024-01-02 03:04:05") }, ErrorSignMalformed},
+		"no x-nonce":       {func(r *http.Request) { r.Header.Del(HeaderNonce) }, ErrorSignMalformed},
+	}
+	for name, c := range cases {
+		r := newTestRequest(t, testBody)
+		setAuthorization(r, "key-id", testSignedHeaders, testSignature)
+		c.prepare(r)
+		if _, err := Parse(r); err != c.err {
+			t.Errorf("Parse %v err = %v, want %v", name, err, c.err)
+		}
+	}
+}
+
+func TestCheckSkew(t *testing.T) {
+	for _, c := range []struct {
+		offset time.Duration
+		err    error
+	}{
+		{0, nil},
+		{-299 * time.Second, nil},
+		{299 * time.Second, nil},
+		{-301 * time.Second, ErrorSignExpired},
+		{301 * time.Second, ErrorSignExpired},
+	} {
+		signature := &Signature{Date: time.Now().Add(c.offset)}
+		if err := signature.CheckSkew(300); err != c.err {
+			t.Errorf("CheckSkew offset %v err = %v, want %v", c.offset, err, c.err)
+		}
+	}
+}
+
+func TestBodyHashLimit(t *testing.T) {
+	r := newTestRequest(t, strings.Repeat("a", 10))
+	if _, err := BodyHash(r, 10); err != nil {
+		t.Errorf("BodyHash at limit err = %v", err)
+	}
+
+	r = newTestRequest(t, strings.Repeat("a", 11))
+	if _, err := BodyHash(r, 10); err != ErrorBodyTooLarge {
+		t.Errorf("BodyHash over limit err = %v, want %v", err, ErrorBodyTooLarge)
+	}
+
+	r = newTestRequest(t, strings.Repeat("a", DefaultMaxBodySize+1))
+	if _, err := BodyHash(r); err != ErrorBodyTooLarge {
+		t.Errorf("BodyHash over default limit err = %v, want %v", err, ErrorBodyTooLarge)
+	}
+
+	r = newTestRequest(t, strings.Repeat("a", DefaultMaxBodySize+1))
+	if _, err := BodyHash(r, -1); err != nil {
+		t.Errorf("BodyHash without limit err = %v", err)
+	}
+
+	r = newTestRequest(t, strings.Repeat("a", 11))
+	setAuthorization(r, "key-id", testSignedHeaders, testSignature)
+	signature, err := Parse(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = signature.Verify(r, testSecret, 10); err != ErrorBodyTooLarge {
+		t.Errorf("Verify over limit err = %v, want %v", err, ErrorBodyTooLarge)
+	}
+}
+
+func TestBodyHashEmpty(t *testing.T) {
+	r, err := http.NewRequest("GET", "https://api.example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodyHash, err := BodyHash(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"; bodyHash != want {
+		t.Errorf("BodyHash(nil) = %v, want %v", bodyHash, want)
+	}
+}
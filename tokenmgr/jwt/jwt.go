@@ -0,0 +1,432 @@
+// Package jwt 基于 JWT 的 token 管理器
+// token 在本地验证签名和有效期, 不需要访问 redis;
+// Clean/CleanAll/Revoke 通过 redis 中按 uid 存储的代数(generation)计数和注销的会话实现, 在本地缓存 cacheTTL 秒
+// 会话ID 即 jti, 会话信息在 Generate 时写入 redis, 仅用于 List
+package jwt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	uuidplus "github.com/cheetah-fun-gs/goplus/uuid"
+	"github.com/cheetah-fun-gs/gouser/tokenmgr"
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+const (
+	allField       = "*"    // 所有来源的代数
+	revokedPrefix  = "sid|" // 注销的会话
+	cacheSizeLimit = 10000  // 本地缓存超过该数量时清理过期数据
+)
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ"`
+}
+
+// Claims token 载荷
+type Claims struct {
+	Subject   string `json:"sub"`  // uid
+	From      string `json:"from"` // 来源
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	ID        string `json:"jti"`
+	Gen       int64  `json:"gen"`  // 签发时该来源的代数
+	GenAll    int64  `json:"gall"` // 签发时所有来源的代数
+}
+
+type cacheValue struct {
+	gens     map[string]int64
+	deadline time.Time
+}
+
+// Mgr JWT 管理器
+type Mgr struct {
+	name       string // 管理器名称
+	expire     int    // 凭证的超时时间
+	pool       *redigo.Pool
+	signingKey *Key            // 签发使用的密钥
+	keys       map[string]*Key // kid: 验证使用的密钥
+	cacheTTL   int             // 代数本地缓存时间 秒, 为0时每次验证都访问redis
+	cache      map[string]*cacheValue
+	mutex      sync.RWMutex
+}
+
+var _ tokenmgr.TokenMgr = &Mgr{}
+
+// New 获得一个新的 JWT token 管理器
+// expires[0]: 凭证的超时时间, 默认1小时
+func New(name string, pool *redigo.Pool, signingKey *Key, expires ...int) *Mgr {
+	mgr := &Mgr{
+		name:     name,
+		pool:     pool,
+		expire:   3600,
+		keys:     map[string]*Key{},
+		cacheTTL: 5,
+		cache:    map[string]*cacheValue{},
+	}
+	if len(expires) >= 1 && expires[0] != 0 {
+		mgr.expire = expires[0]
+	}
+	mgr.SetSigningKey(signingKey)
+	return mgr
+}
+
+// SetSigningKey 设置签发密钥 用于密钥轮换, 旧密钥仍保留用于验证
+func (s *Mgr) SetSigningKey(key *Key) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.signingKey = key
+	s.keys[key.ID] = key
+}
+
+// AddVerifyKey 添加验证密钥 如其他服务签发的公钥
+func (s *Mgr) AddVerifyKey(keys ...*Key) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, key := range keys {
+		s.keys[key.ID] = key
+	}
+}
+
+// RemoveKey 移除密钥 用该密钥签发的 token 全部失效, 不能移除当前签发密钥
+func (s *Mgr) RemoveKey(kid string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.signingKey.ID == kid {
+		return fmt.Errorf("key %v is signing key", kid)
+	}
+	delete(s.keys, kid)
+	return nil
+}
+
+// SetCacheTTL 设置代数的本地缓存时间 Clean/CleanAll 在其他进程中最多延迟 ttl 秒生效
+func (s *Mgr) SetCacheTTL(ttl int) {
+	s.cacheTTL = ttl
+}
+
+func getGenKey(name, uid string) string {
+	return fmt.Sprintf("%s:%s:jwt", name, uid)
+}
+
+func getSessionKey(name, uid string) string {
+	return fmt.Sprintf("%s:%s:jwt:session", name, uid)
+}
+
+// getGens 获取代数 useCache 是否使用本地缓存
+func (s *Mgr) getGens(uid string, useCache bool) (map[string]int64, error) {
+	now := time.Now()
+	if useCache && s.cacheTTL > 0 {
+		s.mutex.RLock()
+		val, ok := s.cache[uid]
+		s.mutex.RUnlock()
+		if ok && val.deadline.After(now) {
+			return val.gens, nil
+		}
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	gens, err := redigo.Int64Map(conn.Do("HGETALL", getGenKey(s.name, uid)))
+	if err != nil {
+		return nil, err
+	}
+
+	if s.cacheTTL > 0 {
+		s.mutex.Lock()
+		if len(s.cache) >= cacheSizeLimit {
+			for key, val := range s.cache {
+				if !val.deadline.After(now) {
+					delete(s.cache, key)
+				}
+			}
+		}
+		s.cache[uid] = &cacheValue{
+			gens:     gens,
+			deadline: now.Add(time.Duration(s.cacheTTL) * time.Second),
+		}
+		s.mutex.Unlock()
+	}
+	return gens, nil
+}
+
+func (s *Mgr) cleanCache(uid string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.cache, uid)
+}
+
+func encodeSegment(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Sign 签发一个 token
+func (s *Mgr) Sign(claims *Claims) (string, error) {
+	s.mutex.RLock()
+	key := s.signingKey
+	s.mutex.RUnlock()
+
+	headerSegment, err := encodeSegment(&header{Alg: key.Algorithm, Kid: key.ID, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claimsSegment, err := encodeSegment(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := headerSegment + "." + claimsSegment
+	signature, err := key.sign([]byte(signingInput))
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Parse 解析 token 并验证签名和有效期 不检查是否被清除
+func (s *Mgr) Parse(token string) (*Claims, bool) {
+	splits := strings.Split(token, ".")
+	if len(splits) != 3 {
+		return nil, false
+	}
+
+	h := &header{}
+	if err := decodeSegment(splits[0], h); err != nil {
+		return nil, false
+	}
+
+	s.mutex.RLock()
+	key, ok := s.keys[h.Kid]
+	s.mutex.RUnlock()
+	if !ok || key.Algorithm != h.Alg { // 算法以密钥为准 防止算法替换攻击
+		return nil, false
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(splits[2])
+	if err != nil {
+		return nil, false
+	}
+	if !key.verify([]byte(splits[0]+"."+splits[1]), signature) {
+		return nil, false
+	}
+
+	claims := &Claims{}
+	if err := decodeSegment(splits[1], claims); err != nil {
+		return nil, false
+	}
+	if claims.ExpiresAt <= time.Now().Unix() {
+		return nil, false
+	}
+	return claims, true
+}
+
+// Generate ...
+func (s *Mgr) Generate(uid, from string, metas ...*tokenmgr.SessionMeta) (token string, deadline int64, err error) {
+	var gens map[string]int64
+	if gens, err = s.getGens(uid, false); err != nil {
+		return
+	}
+
+	now := time.Now()
+	deadline = now.Unix() + int64(s.expire)
+	sessionID := uuidplus.NewV4().Base62()
+	token, err = s.Sign(&Claims{
+		Subject:   uid,
+		From:      from,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: deadline,
+		ID:        sessionID,
+		Gen:       gens[from],
+		GenAll:    gens[allField],
+	})
+	if err != nil {
+		return
+	}
+
+	var session []byte
+	session, err = json.Marshal(&tokenmgr.Session{
+		ID:          sessionID,
+		From:        from,
+		Created:     now.Unix(),
+		Deadline:    deadline,
+		SessionMeta: *tokenmgr.GetMeta(metas...),
+	})
+	if err != nil {
+		return
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	// 代数和注销记录需要比所有已签发的 token 活得久
+	sessionKey := getSessionKey(s.name, uid)
+	commands := [][]interface{}{
+		{"HSET", sessionKey, sessionID, session},
+		{"EXPIREAT", sessionKey, deadline},
+		{"EXPIREAT", getGenKey(s.name, uid), deadline},
+	}
+	for _, command := range commands {
+		if err = conn.Send(command[0].(string), command[1:]...); err != nil {
+			return
+		}
+	}
+	if err = conn.Flush(); err != nil {
+		return
+	}
+	for range commands {
+		if _, err = conn.Receive(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Verify ...
+func (s *Mgr) Verify(uid, from, token string) (ok bool, err error) {
+	claims, ok := s.Parse(token)
+	if !ok || claims.Subject != uid || claims.From != from {
+		return false, nil
+	}
+
+	var gens map[string]int64
+	if gens, err = s.getGens(uid, true); err != nil {
+		return
+	}
+	return claims.Gen == gens[from] && claims.GenAll == gens[allField] && gens[revokedPrefix+claims.ID] == 0, nil
+}
+
+func (s *Mgr) incrGen(conn redigo.Conn, uid, field string) error {
+	genKey := getGenKey(s.name, uid)
+	if err := conn.Send("HINCRBY", genKey, field, 1); err != nil {
+		return err
+	}
+	if err := conn.Send("EXPIRE", genKey, s.expire); err != nil {
+		return err
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := conn.Receive(); err != nil {
+			return err
+		}
+	}
+
+	s.cleanCache(uid)
+	return nil
+}
+
+func (s *Mgr) getSessions(conn redigo.Conn, uid string) ([]*tokenmgr.Session, error) {
+	values, err := redigo.StringMap(conn.Do("HGETALL", getSessionKey(s.name, uid)))
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []*tokenmgr.Session{}
+	for _, value := range values {
+		session := &tokenmgr.Session{}
+		if err = json.Unmarshal([]byte(value), session); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+// Clean ...
+func (s *Mgr) Clean(uid, from string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	if err := s.incrGen(conn, uid, from); err != nil {
+		return err
+	}
+
+	sessions, err := s.getSessions(conn, uid)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if session.From == from {
+			conn.Send("HDEL", getSessionKey(s.name, uid), session.ID)
+		}
+	}
+	return conn.Flush()
+}
+
+// CleanAll ...
+func (s *Mgr) CleanAll(uid string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	if err := s.incrGen(conn, uid, allField); err != nil {
+		return err
+	}
+	_, err := conn.Do("DEL", getSessionKey(s.name, uid))
+	return err
+}
+
+// List ...
+func (s *Mgr) List(uid string) ([]*tokenmgr.Session, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	sessions, err := s.getSessions(conn, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	result := []*tokenmgr.Session{}
+	for _, session := range sessions {
+		if session.Deadline > now {
+			result = append(result, session)
+		} else {
+			conn.Send("HDEL", getSessionKey(s.name, uid), session.ID)
+		}
+	}
+	return result, conn.Flush()
+}
+
+// Revoke ...
+func (s *Mgr) Revoke(uid, sessionID string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	if err := s.incrGen(conn, uid, revokedPrefix+sessionID); err != nil {
+		return err
+	}
+	_, err := conn.Do("HDEL", getSessionKey(s.name, uid), sessionID)
+	return err
+}
+
+// SessionID 即 jti, token 无效时为空
+func (s *Mgr) SessionID(from, token string) string {
+	claims, ok := s.Parse(token)
+	if !ok || claims.From != from {
+		return ""
+	}
+	return claims.ID
+}
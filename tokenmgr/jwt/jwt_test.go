@@ -0,0 +1,360 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+func newTestPool(t *testing.T) (*redigo.Pool, func()) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := &redigo.Pool{
+		Dial: func() (redigo.Conn, error) {
+			return redigo.Dial("tcp", mr.Addr())
+		},
+	}
+	return pool, func() {
+		pool.Close()
+		mr.Close()
+	}
+}
+
+var (
+	testRSAKey     *rsa.PrivateKey
+	testEd25519Key ed25519.PrivateKey
+)
+
+func init() {
+	var err error
+	if testRSAKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		panic(err)
+	}
+	if _, testEd25519Key, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		panic(err)
+	}
+}
+
+func testKeys() map[string]*Key {
+	return map[string]*Key{
+		HS256: NewHS256Key("hs", []byte("test-secret")),
+		RS256: NewRS256Key("rs", testRSAKey, nil),
+		EdDSA: NewEdDSAKey("ed", testEd25519Key, nil),
+	}
+}
+
+// forge 使用指定的头部和签名函数构造 token
+func forge(t *testing.T, h *header, claims *Claims, sign func(data []byte) []byte) string {
+	headerSegment, err := encodeSegment(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimsSegment, err := encodeSegment(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingInput := headerSegment + "." + claimsSegment
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signingInput)))
+}
+
+func validClaims() *Claims {
+	now := time.Now().Unix()
+	return &Claims{Subject: "u1", From: "app", IssuedAt: now, ExpiresAt: now + 3600, ID: "sid"}
+}
+
+func mustVerify(t *testing.T, mgr *Mgr, uid, from, token string, want bool, msg string) {
+	t.Helper()
+	ok, err := mgr.Verify(uid, from, token)
+	if err != nil {
+		t.Fatalf("%v: Verify err: %v", msg, err)
+	}
+	if ok != want {
+		t.Errorf("%v: Verify = %v, want %v", msg, ok, want)
+	}
+}
+
+func TestGenerateVerifyRevoke(t *testing.T) {
+	for alg, key := range testKeys() {
+		t.Run(alg, func(t *testing.T) {
+			pool, closer := newTestPool(t)
+			defer closer()
+			mgr := New("test", pool, key)
+
+			token1, deadline, err := mgr.Generate("u1", "app")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deadline <= time.Now().Unix() {
+				t.Errorf("deadline %v is not in the future", deadline)
+			}
+			token2, _, err := mgr.Generate("u1", "app")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mustVerify(t, mgr, "u1", "app", token1, true, "token1")
+			mustVerify(t, mgr, "u1", "app", token2, true, "token2")
+			mustVerify(t, mgr, "u2", "app", token1, false, "other uid")
+			mustVerify(t, mgr, "u1", "web", token1, false, "other from")
+
+			claims, ok := mgr.Parse(token1)
+			if !ok {
+				t.Fatal("Parse token1 failed")
+			}
+			if claims.Subject != "u1" || claims.From != "app" || claims.ExpiresAt != deadline {
+				t.Errorf("claims = %+v", claims)
+			}
+			if sessionID := mgr.SessionID("app", token1); sessionID != claims.ID {
+				t.Errorf("SessionID = %v, want %v", sessionID, claims.ID)
+			}
+			if sessionID := mgr.SessionID("web", token1); sessionID != "" {
+				t.Errorf("SessionID with other from = %v, want empty", sessionID)
+			}
+
+			// 注销一个会话 另一个会话不受影响
+			if err = mgr.Revoke("u1", claims.ID); err != nil {
+				t.Fatal(err)
+			}
+			mustVerify(t, mgr, "u1", "app", token1, false, "revoked token1")
+			mustVerify(t, mgr, "u1", "app", token2, true, "token2 after revoke")
+
+			sessions, err := mgr.List("u1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sessions) != 1 || sessions[0].ID != mgr.SessionID("app", token2) {
+				t.Errorf("List = %+v, want only token2", sessions)
+			}
+		})
+	}
+}
+
+func TestClean(t *testing.T) {
+	pool, closer := newTestPool(t)
+	defer closer()
+	mgr := New("test", pool, NewHS256Key("hs", []byte("test-secret")))
+
+	app, _, err := mgr.Generate("u1", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	web, _, err := mgr.Generate("u1", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := mgr.Generate("u2", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 按来源清除 代数加一
+	if err = mgr.Clean("u1", "app"); err != nil {
+		t.Fatal(err)
+	}
+	mustVerify(t, mgr, "u1", "app", app, false, "cleaned from")
+	mustVerify(t, mgr, "u1", "web", web, true, "other from")
+	mustVerify(t, mgr, "u2", "app", other, true, "other uid")
+
+	app, _, err = mgr.Generate("u1", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustVerify(t, mgr, "u1", "app", app, true, "new token after Clean")
+
+	// 清除所有来源 * 代数加一
+	if err = mgr.CleanAll("u1"); err != nil {
+		t.Fatal(err)
+	}
+	mustVerify(t, mgr, "u1", "app", app, false, "app after CleanAll")
+	mustVerify(t, mgr, "u1", "web", web, false, "web after CleanAll")
+	mustVerify(t, mgr, "u2", "app", other, true, "other uid after CleanAll")
+
+	web, _, err = mgr.Generate("u1", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustVerify(t, mgr, "u1", "web", web, true, "new token after CleanAll")
+}
+
+func TestRevokeAcrossInstances(t *testing.T) {
+	pool, closer := newTestPool(t)
+	defer closer()
+	key := NewEdDSAKey("ed", testEd25519Key, nil)
+	issuer := New("test", pool, key)
+	verifier := New("test", pool, key)
+	verifier.SetCacheTTL(0)
+
+	token, _, err := issuer.Generate("u1", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustVerify(t, verifier, "u1", "app", token, true, "before revoke")
+
+	if err = issuer.Revoke("u1", issuer.SessionID("app", token)); err != nil {
+		t.Fatal(err)
+	}
+	mustVerify(t, verifier, "u1", "app", token, false, "after revoke in another instance")
+}
+
+func TestKeyRotation(t *testing.T) {
+	pool, closer := newTestPool(t)
+	defer closer()
+	mgr := New("test", pool, NewRS256Key("k1", testRSAKey, nil))
+
+	token1, _, err := mgr.Generate("u1", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mgr.SetSigningKey(NewEdDSAKey("k2", testEd25519Key, nil))
+	token2, _, err := mgr.Generate("u1", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &header{}
+	if err = decodeSegment(strings.Split(token2, ".")[0], h); err != nil {
+		t.Fatal(err)
+	}
+	if h.Kid != "k2" || h.Alg != EdDSA {
+		t.Errorf("token2 header = %+v, want kid k2 alg EdDSA", h)
+	}
+
+	// 旧密钥签发的 token 依然有效
+	mustVerify(t, mgr, "u1", "app", token1, true, "token1 after rotation")
+	mustVerify(t, mgr, "u1", "app", token2, true, "token2")
+
+	// 只有公钥的验证方
+	verifier := New("test", pool, NewHS256Key("local", []byte("unused")))
+	verifier.AddVerifyKey(NewRS256Key("k1", nil, &testRSAKey.PublicKey), NewEdDSAKey("k2", nil, testEd25519Key.Public().(ed25519.PublicKey)))
+	mustVerify(t, verifier, "u1", "app", token1, true, "public key verifier token1")
+	mustVerify(t, verifier, "u1", "app", token2, true, "public key verifier token2")
+
+	if err = mgr.RemoveKey("k2"); err == nil {
+		t.Error("RemoveKey signing key err = nil")
+	}
+	if err = mgr.RemoveKey("k1"); err != nil {
+		t.Fatal(err)
+	}
+	mustVerify(t, mgr, "u1", "app", token1, false, "token1 after RemoveKey")
+	mustVerify(t, mgr, "u1", "app", token2, true, "token2 after RemoveKey")
+
+	// 未知 kid
+	unknown := New("test", pool, NewHS256Key("k3", []byte("other")))
+	mustVerify(t, unknown, "u1", "app", token2, false, "unknown kid")
+}
+
+func TestRejectNone(t *testing.T) {
+	pool, closer := newTestPool(t)
+	defer closer()
+	mgr := New("test", pool, NewHS256Key("hs", []byte("test-secret")))
+
+	empty := func(data []byte) []byte { return nil }
+	for _, h := range []*header{
+		{Alg: "none", Kid: "hs", Typ: "JWT"},
+		{Alg: "none", Typ: "JWT"},
+		{Alg: "NONE", Kid: "hs", Typ: "JWT"},
+	} {
+		token := forge(t, h, validClaims(), empty)
+		if _, ok := mgr.Parse(token); ok {
+			t.Errorf("Parse alg %v kid %q = true, want false", h.Alg, h.Kid)
+		}
+		mustVerify(t, mgr, "u1", "app", token, false, "alg none")
+		// 去掉签名段
+		if _, ok := mgr.Parse(strings.TrimSuffix(token, ".")); ok {
+			t.Errorf("Parse alg %v without signature segment = true, want false", h.Alg)
+		}
+	}
+}
+
+func TestRejectAlgMismatch(t *testing.T) {
+	pool, closer := newTestPool(t)
+	defer closer()
+	mgr := New("test", pool, NewRS256Key("rs", testRSAKey, nil))
+	mgr.AddVerifyKey(NewEdDSAKey("ed", nil, testEd25519Key.Public().(ed25519.PublicKey)))
+
+	// 用公开的 RSA 公钥作为 HMAC 密钥 伪造 HS256 签名
+	publicKey, err := x509.MarshalPKIXPublicKey(&testRSAKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs256 := func(data []byte) []byte {
+		h := hmac.New(sha256.New, publicKey)
+		h.Write(data)
+		return h.Sum(nil)
+	}
+	token := forge(t, &header{Alg: HS256, Kid: "rs", Typ: "JWT"}, validClaims(), hs256)
+	if _, ok := mgr.Parse(token); ok {
+		t.Error("Parse HS256 signed with RSA public key = true, want false")
+	}
+
+	// 头部算法与密钥不一致 即使签名正确也拒绝
+	rsKey := NewRS256Key("ed", testRSAKey, nil)
+	signature := func(data []byte) []byte {
+		sig, err := rsKey.sign(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+	token = forge(t, &header{Alg: RS256, Kid: "ed", Typ: "JWT"}, validClaims(), signature)
+	if _, ok := mgr.Parse(token); ok {
+		t.Error("Parse RS256 header with EdDSA key = true, want false")
+	}
+	token = forge(t, &header{Alg: EdDSA, Kid: "rs", Typ: "JWT"}, validClaims(), func(data []byte) []byte {
+		return ed25519.Sign(testEd25519Key, data)
+	})
+	if _, ok := mgr.Parse(token); ok {
+		t.Error("Parse EdDSA header with RS256 key = true, want false")
+	}
+}
+
+func TestRejectTampered(t *testing.T) {
+	pool, closer := newTestPool(t)
+	defer closer()
+	mgr := New("test", pool, NewHS256Key("hs", []byte("test-secret")))
+
+	token, _, err := mgr.Generate("u1", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	splits := strings.Split(token, ".")
+	claims := &Claims{}
+	if err = decodeSegment(splits[1], claims); err != nil {
+		t.Fatal(err)
+	}
+	claims.Subject = "u2"
+	claimsSegment, err := encodeSegment(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustVerify(t, mgr, "u2", "app", splits[0]+"."+claimsSegment+"."+splits[2], false, "tampered subject")
+
+	for _, malformed := range []string{"", "a.b", "a.b.c.d", splits[0] + "." + splits[1] + ".!!!"} {
+		if _, ok := mgr.Parse(malformed); ok {
+			t.Errorf("Parse(%q) = true, want false", malformed)
+		}
+	}
+
+	// 过期
+	expired := validClaims()
+	expired.ExpiresAt = time.Now().Unix() - 1
+	token, err = mgr.Sign(expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mgr.Parse(token); ok {
+		t.Error("Parse expired token = true, want false")
+	}
+}
@@ -0,0 +1,99 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+)
+
+// 签名算法
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	EdDSA = "EdDSA"
+)
+
+// Key 签名密钥 ID 对应 jwt 头部的 kid
+// 签发需要私钥(HS256为Secret), 验证只需要公钥
+type Key struct {
+	ID         string
+	Algorithm  string
+	Secret     []byte
+	PrivateKey crypto.PrivateKey // *rsa.PrivateKey 或 ed25519.PrivateKey
+	PublicKey  crypto.PublicKey  // *rsa.PublicKey 或 ed25519.PublicKey
+}
+
+// NewHS256Key HS256 密钥
+func NewHS256Key(kid string, secret []byte) *Key {
+	return &Key{ID: kid, Algorithm: HS256, Secret: secret}
+}
+
+// NewRS256Key RS256 密钥 privateKey 为nil时仅用于验证
+func NewRS256Key(kid string, privateKey *rsa.PrivateKey, publicKey *rsa.PublicKey) *Key {
+	key := &Key{ID: kid, Algorithm: RS256, PublicKey: publicKey}
+	if privateKey != nil {
+		key.PrivateKey = privateKey
+		key.PublicKey = &privateKey.PublicKey
+	}
+	return key
+}
+
+// NewEdDSAKey EdDSA(Ed25519) 密钥 privateKey 为nil时仅用于验证
+func NewEdDSAKey(kid string, privateKey ed25519.PrivateKey, publicKey ed25519.PublicKey) *Key {
+	key := &Key{ID: kid, Algorithm: EdDSA, PublicKey: publicKey}
+	if privateKey != nil {
+		key.PrivateKey = privateKey
+		key.PublicKey = privateKey.Public()
+	}
+	return key
+}
+
+func (key *Key) sign(data []byte) ([]byte, error) {
+	switch key.Algorithm {
+	case HS256:
+		h := hmac.New(sha256.New, key.Secret)
+		h.Write(data)
+		return h.Sum(nil), nil
+	case RS256:
+		privateKey, ok := key.PrivateKey.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("key %v has no rsa private key", key.ID)
+		}
+		digest := sha256.Sum256(data)
+		return rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, digest[:])
+	case EdDSA:
+		privateKey, ok := key.PrivateKey.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("key %v has no ed25519 private key", key.ID)
+		}
+		return ed25519.Sign(privateKey, data), nil
+	}
+	return nil, fmt.Errorf("algorithm %v is not support", key.Algorithm)
+}
+
+func (key *Key) verify(data, signature []byte) bool {
+	switch key.Algorithm {
+	case HS256:
+		h := hmac.New(sha256.New, key.Secret)
+		h.Write(data)
+		return hmac.Equal(h.Sum(nil), signature)
+	case RS256:
+		publicKey, ok := key.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		digest := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature) == nil
+	case EdDSA:
+		publicKey, ok := key.PublicKey.(ed25519.PublicKey)
+		if !ok {
+			return false
+		}
+		return ed25519.Verify(publicKey, data, signature)
+	}
+	return false
+}
@@ -0,0 +1,329 @@
+package tokenmgr
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	uuidplus "github.com/cheetah-fun-gs/goplus/uuid"
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+// 刷新令牌错误
+var (
+	ErrorRefreshTokenInvalid = fmt.Errorf("refresh token is invalid")
+	ErrorRefreshTokenReused  = fmt.Errorf("refresh token is reused")
+)
+
+// RefreshReusedError 已使用过的刷新令牌再次被使用 令牌族已作废
+// SessionIDs 为令牌族绑定的会话, 需由调用方一并注销; errors.Is(err, ErrorRefreshTokenReused) 为 true
+type RefreshReusedError struct {
+	UID        string
+	SessionIDs []string
+}
+
+func (e *RefreshReusedError) Error() string {
+	return ErrorRefreshTokenReused.Error()
+}
+
+// Unwrap ...
+func (e *RefreshReusedError) Unwrap() error {
+	return ErrorRefreshTokenReused
+}
+
+// RefreshMgr 刷新令牌管理器
+// 刷新令牌每使用一次就轮换成新的, 同一次登录产生的令牌属于同一个令牌族;
+// 已使用过的刷新令牌再次被使用时, 视为泄露, 整个令牌族作废;
+// 令牌族绑定到用它换取的token的会话ID, 注销会话时一并作废;
+// 令牌族的有效期从登录时开始计算, 轮换不会延长
+// 数据结构
+// refresh token : map{uid, from, family, deadline, used}
+// family : set[refresh token]
+// uid : map[family]from
+// uid session : map[sessionID]family
+type RefreshMgr struct {
+	name   string // 管理器名称
+	expire int    // 刷新令牌的超时时间
+	pool   *redigo.Pool
+}
+
+// NewRefreshMgr 获得一个新的刷新令牌管理器
+// expires[0]: 刷新令牌的超时时间, 默认30天
+func NewRefreshMgr(name string, pool *redigo.Pool, expires ...int) *RefreshMgr {
+	mgr := &RefreshMgr{
+		name:   name,
+		pool:   pool,
+		expire: 3600 * 24 * 30,
+	}
+	if len(expires) >= 1 && expires[0] != 0 {
+		mgr.expire = expires[0]
+	}
+	return mgr
+}
+
+func getRefreshKey(name, refreshToken string) string {
+	return fmt.Sprintf("%s:refresh:%s", name, refreshToken)
+}
+
+func getRefreshFamilyKey(name, family string) string {
+	return fmt.Sprintf("%s:refresh:family:%s", name, family)
+}
+
+func getRefreshUserKey(name, uid string) string {
+	return fmt.Sprintf("%s:%s:refresh", name, uid)
+}
+
+func getRefreshSessionKey(name, uid string) string {
+	return fmt.Sprintf("%s:%s:refresh:session", name, uid)
+}
+
+// 标记刷新令牌已使用
+// KEYS[1]: 刷新令牌key
+// 返回 nil 不存在; [uid, from, family, used, deadline] used 为 "1" 表示之前已使用过
+var useRefreshScript = redigo.NewScript(1, `local v = redis.call("HMGET", KEYS[1], "uid", "from", "family", "used", "deadline")
+	if not v[1]
+	then
+		return nil
+	end
+	if v[4] ~= "1"
+	then
+		redis.call("HSET", KEYS[1], "used", "1")
+	end
+	if not v[5]
+	then
+		v[5] = ""
+	end
+	return v`)
+
+// 设置key的过期时间 只延长不缩短, 用于多个令牌族共用的key
+// KEYS[1]: key ARGV[1]: 过期时间点 ARGV[2]: 当前时间
+var expireAtLeastScript = redigo.NewScript(1, `local ttl = redis.call("TTL", KEYS[1])
+	if ttl == -1 or tonumber(ARGV[2]) + ttl < tonumber(ARGV[1])
+	then
+		redis.call("EXPIREAT", KEYS[1], ARGV[1])
+	end
+	return 1`)
+
+// create 生成令牌族中的新令牌 有效期到令牌族的 deadline 为止, sessionID 不为空时绑定到会话
+func (s *RefreshMgr) create(conn redigo.Conn, uid, from, family, sessionID string, deadline int64) (refreshToken string, err error) {
+	refreshToken = uuidplus.NewV4().Base62() + uuidplus.NewV4().Base62()
+
+	refreshKey := getRefreshKey(s.name, refreshToken)
+	familyKey := getRefreshFamilyKey(s.name, family)
+	userKey := getRefreshUserKey(s.name, uid)
+	commands := [][]interface{}{
+		{"HMSET", refreshKey, "uid", uid, "from", from, "family", family, "deadline", deadline, "used", "0"},
+		{"EXPIREAT", refreshKey, deadline},
+		{"SADD", familyKey, refreshToken},
+		{"EXPIREAT", familyKey, deadline},
+		{"HSET", userKey, family, from},
+	}
+	if sessionID != "" {
+		commands = append(commands, []interface{}{"HSET", getRefreshSessionKey(s.name, uid), sessionID, family})
+	}
+	for _, command := range commands {
+		if err = conn.Send(command[0].(string), command[1:]...); err != nil {
+			return
+		}
+	}
+	if err = conn.Flush(); err != nil {
+		return
+	}
+	for range commands {
+		if _, err = conn.Receive(); err != nil {
+			return
+		}
+	}
+
+	if err = s.expireAtLeast(conn, userKey, deadline); err != nil {
+		return
+	}
+	if sessionID != "" {
+		err = s.expireAtLeast(conn, getRefreshSessionKey(s.name, uid), deadline)
+	}
+	return
+}
+
+func (s *RefreshMgr) expireAtLeast(conn redigo.Conn, key string, deadline int64) error {
+	_, err := expireAtLeastScript.Do(conn, key, deadline, time.Now().Unix())
+	return err
+}
+
+// revokeFamily 作废令牌族 返回令牌族绑定的会话ID
+func (s *RefreshMgr) revokeFamily(conn redigo.Conn, uid, family string) ([]string, error) {
+	familyKey := getRefreshFamilyKey(s.name, family)
+	refreshTokens, err := redigo.Strings(conn.Do("SMEMBERS", familyKey))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []interface{}{familyKey}
+	for _, refreshToken := range refreshTokens {
+		keys = append(keys, getRefreshKey(s.name, refreshToken))
+	}
+	if _, err = conn.Do("DEL", keys...); err != nil {
+		return nil, err
+	}
+	if _, err = conn.Do("HDEL", getRefreshUserKey(s.name, uid), family); err != nil {
+		return nil, err
+	}
+
+	sessionKey := getRefreshSessionKey(s.name, uid)
+	sessions, err := redigo.StringMap(conn.Do("HGETALL", sessionKey))
+	if err != nil {
+		return nil, err
+	}
+	sessionIDs := []string{}
+	args := []interface{}{sessionKey}
+	for sessionID, sessionFamily := range sessions {
+		if sessionFamily == family {
+			sessionIDs = append(sessionIDs, sessionID)
+			args = append(args, sessionID)
+		}
+	}
+	if len(sessionIDs) > 0 {
+		if _, err = conn.Do("HDEL", args...); err != nil {
+			return nil, err
+		}
+	}
+	return sessionIDs, nil
+}
+
+// Generate 生成一个新的刷新令牌 开启一个新的令牌族, 绑定到会话 sessionID
+func (s *RefreshMgr) Generate(uid, from, sessionID string) (refreshToken string, deadline int64, err error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	deadline = time.Now().Unix() + int64(s.expire)
+	refreshToken, err = s.create(conn, uid, from, uuidplus.NewV4().Base62(), sessionID, deadline)
+	return
+}
+
+// Rotate 使用刷新令牌 旧令牌作废, 返回同一令牌族的新令牌 新令牌的有效期与令牌族一致
+// 已使用过的刷新令牌再次被使用时作废令牌族, 返回 *RefreshReusedError
+func (s *RefreshMgr) Rotate(refreshToken string) (uid, from, newRefreshToken string, deadline int64, err error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	var result []string
+	result, err = redigo.Strings(useRefreshScript.Do(conn, getRefreshKey(s.name, refreshToken)))
+	if err == redigo.ErrNil {
+		err = ErrorRefreshTokenInvalid
+		return
+	} else if err != nil {
+		return
+	}
+
+	uid, from = result[0], result[1]
+	family, used := result[2], result[3]
+	if used == "1" {
+		var sessionIDs []string
+		if sessionIDs, err = s.revokeFamily(conn, uid, family); err != nil {
+			return "", "", "", 0, err
+		}
+		return "", "", "", 0, &RefreshReusedError{UID: uid, SessionIDs: sessionIDs}
+	}
+
+	// 旧数据没有记录令牌族的有效期
+	if deadline, _ = strconv.ParseInt(result[4], 10, 64); deadline == 0 {
+		deadline = time.Now().Unix() + int64(s.expire)
+	}
+	newRefreshToken, err = s.create(conn, uid, from, family, "", deadline)
+	return
+}
+
+// Bind 把刷新令牌所在的令牌族绑定到会话 sessionID 轮换后用新的token的会话ID调用
+// 令牌族之前绑定的会话依然有效, 注销其中任一会话都会作废令牌族
+func (s *RefreshMgr) Bind(refreshToken, sessionID string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	refreshKey := getRefreshKey(s.name, refreshToken)
+	result, err := redigo.Strings(conn.Do("HMGET", refreshKey, "uid", "family"))
+	if err != nil {
+		return err
+	}
+	if result[0] == "" {
+		return ErrorRefreshTokenInvalid
+	}
+	ttl, err := redigo.Int(conn.Do("TTL", refreshKey))
+	if err != nil {
+		return err
+	}
+
+	sessionKey := getRefreshSessionKey(s.name, result[0])
+	if _, err = conn.Do("HSET", sessionKey, sessionID, result[1]); err != nil {
+		return err
+	}
+	return s.expireAtLeast(conn, sessionKey, time.Now().Unix()+int64(ttl))
+}
+
+// Revoke 作废刷新令牌所在的令牌族
+func (s *RefreshMgr) Revoke(refreshToken string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	result, err := redigo.Strings(conn.Do("HMGET", getRefreshKey(s.name, refreshToken), "uid", "family"))
+	if err != nil {
+		return err
+	}
+	if result[0] == "" {
+		return nil
+	}
+	_, err = s.revokeFamily(conn, result[0], result[1])
+	return err
+}
+
+// RevokeSession 作废绑定到会话 sessionID 的令牌族
+func (s *RefreshMgr) RevokeSession(uid, sessionID string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	sessionKey := getRefreshSessionKey(s.name, uid)
+	family, err := redigo.String(conn.Do("HGET", sessionKey, sessionID))
+	if err == redigo.ErrNil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_, err = s.revokeFamily(conn, uid, family)
+	return err
+}
+
+// RevokeFrom 作废用户某个来源的全部刷新令牌
+func (s *RefreshMgr) RevokeFrom(uid, from string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	families, err := redigo.StringMap(conn.Do("HGETALL", getRefreshUserKey(s.name, uid)))
+	if err != nil {
+		return err
+	}
+	for family, familyFrom := range families {
+		if familyFrom != from {
+			continue
+		}
+		if _, err = s.revokeFamily(conn, uid, family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RevokeAll 作废用户的全部刷新令牌
+func (s *RefreshMgr) RevokeAll(uid string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	families, err := redigo.Strings(conn.Do("HKEYS", getRefreshUserKey(s.name, uid)))
+	if err != nil {
+		return err
+	}
+	for _, family := range families {
+		if _, err = s.revokeFamily(conn, uid, family); err != nil {
+			return err
+		}
+	}
+	_, err = conn.Do("DEL", getRefreshSessionKey(s.name, uid))
+	return err
+}
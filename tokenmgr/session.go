@@ -0,0 +1,25 @@
+package tokenmgr
+
+// SessionMeta 客户端信息 登录时提供
+type SessionMeta struct {
+	IP        string `json:"ip,omitempty"`         // 客户端IP
+	UserAgent string `json:"user_agent,omitempty"` // 客户端UA
+	Device    string `json:"device,omitempty"`     // 设备名称
+}
+
+// Session 会话 一个有效的token对应一个会话
+type Session struct {
+	ID       string `json:"id,omitempty"`       // 会话ID 不是token
+	From     string `json:"from,omitempty"`     // 来源
+	Created  int64  `json:"created,omitempty"`  // 创建时间
+	Deadline int64  `json:"deadline,omitempty"` // 到期时间
+	SessionMeta
+}
+
+// GetMeta 获取可选的客户端信息
+func GetMeta(metas ...*SessionMeta) *SessionMeta {
+	if len(metas) > 0 && metas[0] != nil {
+		return metas[0]
+	}
+	return &SessionMeta{}
+}
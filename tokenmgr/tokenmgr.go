@@ -1,8 +1,14 @@
 // Package tokenmgr 支持多端登录，生成新token后旧token还有5分钟有效期
+// 可按来源设置并发会话策略: 最大并发会话数、单会话模式、多个来源共享名额的互斥组
+// 可启用滑动续期: 活跃用户的token在验证时自动延期, 但不超过最长有效期
 package tokenmgr
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
@@ -14,19 +20,33 @@ import (
 
 // TokenMgr Token管理器定义
 type TokenMgr interface {
-	Generate(uid, from string) (token string, deadline int64, err error) // 生成一个新的token
-	Verify(uid, from, token string) (ok bool, err error)                 // 验证token是否有效
-	Clean(uid, from string) error                                        // 清除token
-	CleanAll(uid string) error                                           // 清除token
+	Generate(uid, from string, metas ...*SessionMeta) (token string, deadline int64, err error) // 生成一个新的token
+	Verify(uid, from, token string) (ok bool, err error)                                        // 验证token是否有效
+	Clean(uid, from string) error                                                               // 清除token
+	CleanAll(uid string) error                                                                  // 清除token
+	List(uid string) ([]*Session, error)                                                        // 有效的会话列表
+	Revoke(uid, sessionID string) error                                                         // 注销一个会话
+	SessionID(from, token string) string                                                        // token对应的会话ID
+}
+
+// Policy 并发会话策略 按来源设置
+type Policy struct {
+	MaxSessions int    // 最大并发会话数, 超出时淘汰最早的会话, 默认1
+	IsSingle    bool   // 单会话模式, 新token生成后旧token立即失效, 不保留expire2
+	Group       string // 互斥组, 同组的来源共享会话配额, 如 ios 和 android 共用一个名额
 }
 
 // DefaultMgr 默认管理器
-// 数据结构 uid : map[from-token]create_time
+// 数据结构 uid : map[from-token]deadline
+// 会话信息 uid : map[from-token]session
 type DefaultMgr struct {
 	name          string // 管理器名称
 	expire1       int    // 凭证的超时时间, 不宜太短应该比expire2长
 	expire2       int    // 被刷新凭证的保留时间, 不宜太长, 可为0
 	pool          *redigo.Pool
+	policies      map[string]*Policy // 来源: 并发会话策略
+	slideInterval int                // 滑动续期的最小间隔, 为0不启用
+	maxLifetime   int                // 滑动续期的最长有效期, 从创建开始计算
 	generateToken func(uid, from string) string
 	mlogname      string
 }
@@ -40,6 +60,7 @@ func New(name string, pool *redigo.Pool, expires ...int) *DefaultMgr {
 		pool:          pool,
 		expire1:       3600,
 		expire2:       300,
+		policies:      map[string]*Policy{},
 		generateToken: defaultGenerateToken,
 		mlogname:      "default",
 	}
@@ -65,6 +86,39 @@ func (s *DefaultMgr) SetGenerateToken(v func(uid, from string) string) {
 	s.generateToken = v
 }
 
+// SetSliding 启用滑动续期 验证通过时延长token有效期, 至少间隔 interval 秒才写一次, 有效期最长 maxLifetime 秒
+func (s *DefaultMgr) SetSliding(interval, maxLifetime int) {
+	if interval <= 0 || interval >= s.expire1-s.expire2 {
+		panic("interval must be between 0 and expire1-expire2")
+	}
+	if maxLifetime < s.expire1 {
+		panic("maxLifetime is below expire1")
+	}
+	s.slideInterval = interval
+	s.maxLifetime = maxLifetime
+}
+
+// SetPolicy 设置来源的并发会话策略 未设置的来源仅保留一个会话, 被替换的旧token保留expire2
+func (s *DefaultMgr) SetPolicy(from string, policy *Policy) {
+	s.policies[from] = policy
+}
+
+func (s *DefaultMgr) getPolicy(from string) *Policy {
+	if policy, ok := s.policies[from]; ok {
+		return policy
+	}
+	return &Policy{}
+}
+
+// isSameQuota 是否和from共享会话配额
+func (s *DefaultMgr) isSameQuota(field, from string, policy *Policy) bool {
+	fieldFrom := strings.SplitN(field, "|", 2)[0]
+	if policy.Group == "" {
+		return fieldFrom == from
+	}
+	return s.getPolicy(fieldFrom).Group == policy.Group
+}
+
 func defaultGenerateToken(uid, from string) string {
 	return uuidplus.NewV4().Base62()
 }
@@ -81,13 +135,33 @@ func isFromToken(field, from string) bool {
 	return strings.HasPrefix(field, from+"|")
 }
 
+func getSessionKey(name, uid string) string {
+	return fmt.Sprintf("%s:%s:session", name, uid)
+}
+
+// getSessionID 会话ID 由token计算, 不可反推token
+func getSessionID(field string) string {
+	h := sha256.Sum256([]byte(field))
+	return hex.EncodeToString(h[:16])
+}
+
+type sessionValue struct {
+	Created int64 `json:"created,omitempty"`
+	SessionMeta
+}
+
 // Generate ...
-func (s *DefaultMgr) Generate(uid, from string) (token string, deadline int64, err error) {
+func (s *DefaultMgr) Generate(uid, from string, metas ...*SessionMeta) (token string, deadline int64, err error) {
 	conn := s.pool.Get()
 	defer conn.Close()
 
 	tokenKey := getTokenKey(s.name, uid)
+	sessionKey := getSessionKey(s.name, uid)
+	policy := s.getPolicy(from)
 	lockName := fmt.Sprintf("%s:%s:locker", tokenKey, from)
+	if policy.Group != "" {
+		lockName = fmt.Sprintf("%s:group:%s:locker", tokenKey, policy.Group)
+	}
 
 	// 加锁
 	var l *locker.Locker
@@ -107,29 +181,57 @@ func (s *DefaultMgr) Generate(uid, from string) (token string, deadline int64, e
 		return
 	}
 
-	var latestDeadline int64
-	for filed, oldDeadline := range result {
-		if !isFromToken(filed, from) {
-			delete(result, filed) // 不是该from的数据忽略
-			continue
+	commands := []string{}
+	del := func(filed string) error {
+		if err := conn.Send("HDEL", tokenKey, filed); err != nil {
+			return err
 		}
-		if oldDeadline > latestDeadline {
-			latestDeadline = oldDeadline
+		commands = append(commands, fmt.Sprint("HDEL", tokenKey, filed))
+		if err := conn.Send("HDEL", sessionKey, filed); err != nil {
+			return err
 		}
+		commands = append(commands, fmt.Sprint("HDEL", sessionKey, filed))
+		return nil
 	}
 
-	commands := []string{}
+	// 同一配额内未过期的token 按到期时间从新到旧排序
+	actives := []string{}
 	for filed, oldDeadline := range result {
-		if oldDeadline < latestDeadline || oldDeadline < now.Unix() {
-			if err = conn.Send("HDEL", tokenKey, filed); err != nil { // 废弃或过期的token全部删除
+		if !s.isSameQuota(filed, from, policy) {
+			continue // 不是同一配额的数据忽略
+		}
+		if oldDeadline < now.Unix() {
+			if err = del(filed); err != nil { // 过期的token全部删除
 				return
 			}
-			commands = append(commands, fmt.Sprint("HDEL", tokenKey, filed))
-		} else if oldDeadline > now.Unix()+int64(s.expire2) {
-			if err = conn.Send("HSET", tokenKey, filed, now.Unix()+int64(s.expire2)); err != nil { // 未失效的token 5分钟后失效
-				return
+			continue
+		}
+		actives = append(actives, filed)
+	}
+	sort.Slice(actives, func(i, j int) bool {
+		return result[actives[i]] > result[actives[j]]
+	})
+
+	// 新token占用一个名额, 超出的旧token淘汰; 非单会话模式下最近被淘汰的token保留expire2
+	maxSessions := policy.MaxSessions
+	if maxSessions < 1 || policy.IsSingle {
+		maxSessions = 1
+	}
+	for i, filed := range actives {
+		if i < maxSessions-1 {
+			continue
+		}
+		if i == maxSessions-1 && !policy.IsSingle {
+			if result[filed] > now.Unix()+int64(s.expire2) {
+				if err = conn.Send("HSET", tokenKey, filed, now.Unix()+int64(s.expire2)); err != nil { // 未失效的token 5分钟后失效
+					return
+				}
+				commands = append(commands, fmt.Sprint("HSET", tokenKey, filed, now.Unix()+int64(s.expire2)))
 			}
-			commands = append(commands, fmt.Sprint("HSET", tokenKey, filed, now.Unix()+int64(s.expire2)))
+			continue
+		}
+		if err = del(filed); err != nil {
+			return
 		}
 	}
 
@@ -139,8 +241,23 @@ func (s *DefaultMgr) Generate(uid, from string) (token string, deadline int64, e
 	}
 	commands = append(commands, fmt.Sprint("EXPIREAT", tokenKey, deadline))
 
-	// 设定token和deadline
+	// 设定会话信息
 	tokenField := getTokenField(from, token)
+	var session []byte
+	session, err = json.Marshal(&sessionValue{Created: now.Unix(), SessionMeta: *GetMeta(metas...)})
+	if err != nil {
+		return
+	}
+	if err = conn.Send("HSET", sessionKey, tokenField, session); err != nil {
+		return
+	}
+	commands = append(commands, fmt.Sprint("HSET", sessionKey, tokenField, string(session)))
+	if err = conn.Send("EXPIREAT", sessionKey, deadline); err != nil {
+		return
+	}
+	commands = append(commands, fmt.Sprint("EXPIREAT", sessionKey, deadline))
+
+	// 设定token和deadline
 	if err = conn.Send("HSET", tokenKey, tokenField, deadline); err != nil {
 		return
 	}
@@ -177,7 +294,63 @@ func (s *DefaultMgr) Verify(uid, from, token string) (ok bool, err error) {
 	if err != nil && err != redigo.ErrNil {
 		return
 	}
-	return deadline > time.Now().Unix(), nil
+
+	now := time.Now().Unix()
+	if deadline <= now {
+		return false, nil
+	}
+
+	// 滑动续期 被替换后保留expire2的token不续期
+	if s.slideInterval > 0 && deadline > now+int64(s.expire2) && deadline <= now+int64(s.expire1-s.slideInterval) {
+		if errSlide := s.slide(conn, uid, tokenField, deadline); errSlide != nil {
+			mlogger.WarnN(s.mlogname, "Verify slide token %v err: %v", uid, errSlide)
+		}
+	}
+	return true, nil
+}
+
+// 续期 仅在token未被并发修改时生效
+// KEYS[1]: token key KEYS[2]: 会话 key
+// ARGV[1]: from-token ARGV[2]: 原deadline ARGV[3]: 新deadline ARGV[4]: 距新deadline的秒数
+var slideScript = redigo.NewScript(2, `if redis.call("HGET", KEYS[1], ARGV[1]) ~= ARGV[2]
+	then
+		return 0
+	end
+	redis.call("HSET", KEYS[1], ARGV[1], ARGV[3])
+	for i = 1, 2 do
+		local ttl = redis.call("TTL", KEYS[i])
+		if ttl >= 0 and ttl < tonumber(ARGV[4])
+		then
+			redis.call("EXPIREAT", KEYS[i], ARGV[3])
+		end
+	end
+	return 1`)
+
+func (s *DefaultMgr) slide(conn redigo.Conn, uid, tokenField string, deadline int64) error {
+	sessionKey := getSessionKey(s.name, uid)
+	data, err := redigo.Bytes(conn.Do("HGET", sessionKey, tokenField))
+	if err == redigo.ErrNil {
+		return nil // 没有创建时间 无法计算最长有效期 不续期
+	} else if err != nil {
+		return err
+	}
+
+	value := &sessionValue{}
+	if err = json.Unmarshal(data, value); err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	newDeadline := now + int64(s.expire1)
+	if maxDeadline := value.Created + int64(s.maxLifetime); newDeadline > maxDeadline {
+		newDeadline = maxDeadline
+	}
+	if newDeadline <= deadline {
+		return nil
+	}
+
+	_, err = slideScript.Do(conn, getTokenKey(s.name, uid), sessionKey, tokenField, deadline, newDeadline, newDeadline-now)
+	return err
 }
 
 // Clean ...
@@ -186,6 +359,7 @@ func (s *DefaultMgr) Clean(uid, from string) error {
 	defer conn.Close()
 
 	tokenKey := getTokenKey(s.name, uid)
+	sessionKey := getSessionKey(s.name, uid)
 	fields, err := redigo.Strings(conn.Do("HKEYS", tokenKey))
 	if err != nil {
 		return err
@@ -194,6 +368,7 @@ func (s *DefaultMgr) Clean(uid, from string) error {
 	for _, field := range fields {
 		if isFromToken(field, from) {
 			conn.Send("HDEL", tokenKey, field)
+			conn.Send("HDEL", sessionKey, field)
 		}
 	}
 
@@ -206,6 +381,73 @@ func (s *DefaultMgr) CleanAll(uid string) (err error) {
 	defer conn.Close()
 
 	tokenKey := getTokenKey(s.name, uid)
-	_, err = conn.Do("DEL", tokenKey)
+	sessionKey := getSessionKey(s.name, uid)
+	_, err = conn.Do("DEL", tokenKey, sessionKey)
 	return
 }
+
+// List ...
+func (s *DefaultMgr) List(uid string) ([]*Session, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	deadlines, err := redigo.Int64Map(conn.Do("HGETALL", getTokenKey(s.name, uid)))
+	if err != nil {
+		return nil, err
+	}
+	values, err := redigo.StringMap(conn.Do("HGETALL", getSessionKey(s.name, uid)))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	sessions := []*Session{}
+	for field, deadline := range deadlines {
+		if deadline <= now {
+			continue
+		}
+
+		value := &sessionValue{}
+		if data, ok := values[field]; ok {
+			if err = json.Unmarshal([]byte(data), value); err != nil {
+				mlogger.WarnN(s.mlogname, "List session %v err: %v", uid, err)
+			}
+		}
+		sessions = append(sessions, &Session{
+			ID:          getSessionID(field),
+			From:        strings.SplitN(field, "|", 2)[0],
+			Created:     value.Created,
+			Deadline:    deadline,
+			SessionMeta: value.SessionMeta,
+		})
+	}
+	return sessions, nil
+}
+
+// SessionID ...
+func (s *DefaultMgr) SessionID(from, token string) string {
+	return getSessionID(getTokenField(from, token))
+}
+
+// Revoke ...
+func (s *DefaultMgr) Revoke(uid, sessionID string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	tokenKey := getTokenKey(s.name, uid)
+	fields, err := redigo.Strings(conn.Do("HKEYS", tokenKey))
+	if err != nil {
+		return err
+	}
+
+	for _, field := range fields {
+		if getSessionID(field) == sessionID {
+			if _, err = conn.Do("HDEL", tokenKey, field); err != nil {
+				return err
+			}
+			_, err = conn.Do("HDEL", getSessionKey(s.name, uid), field)
+			return err
+		}
+	}
+	return nil
+}
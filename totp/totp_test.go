@@ -0,0 +1,114 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// RFC 6238 Appendix B 的 SHA1 测试向量, 密钥为 ASCII "12345678901234567890"
+// 附录给出8位密码, 6位密码取其后6位
+var rfc6238Secret = encoding.EncodeToString([]byte("12345678901234567890"))
+
+var rfc6238Vectors = []struct {
+	unix int64
+	step int64
+	code string
+}{
+	{59, 0x1, "94287082"},
+	{1111111109, 0x23523EC, "07081804"},
+	{1111111111, 0x23523ED, "14050471"},
+	{1234567890, 0x273EF07, "89005924"},
+	{2000000000, 0x3F940AA, "69279037"},
+	{20000000000, 0x27BC86AA, "65353130"},
+}
+
+func TestCodeRFC6238(t *testing.T) {
+	for _, v := range rfc6238Vectors {
+		now := time.Unix(v.unix, 0)
+		if step := Step(now); step != v.step {
+			t.Errorf("Step(%v) = %v, want %v", v.unix, step, v.step)
+		}
+		got, err := Code(rfc6238Secret, now)
+		if err != nil {
+			t.Fatalf("Code(%v) err: %v", v.unix, err)
+		}
+		if want := v.code[len(v.code)-Digits:]; got != want {
+			t.Errorf("Code(%v) = %v, want %v", v.unix, got, want)
+		}
+	}
+}
+
+func TestVerifyRFC6238(t *testing.T) {
+	for _, v := range rfc6238Vectors {
+		now := time.Unix(v.unix, 0)
+		passcode := v.code[len(v.code)-Digits:]
+		ok, step, err := Verify(rfc6238Secret, passcode, now, 0)
+		if err != nil {
+			t.Fatalf("Verify(%v) err: %v", v.unix, err)
+		}
+		if !ok || step != v.step {
+			t.Errorf("Verify(%v) = %v %v, want true %v", v.unix, ok, step, v.step)
+		}
+	}
+}
+
+func TestVerifySkew(t *testing.T) {
+	v := rfc6238Vectors[1]
+	passcode := v.code[len(v.code)-Digits:]
+	for _, c := range []struct {
+		offset int64
+		skew   int
+		ok     bool
+	}{
+		{Period, 1, true},
+		{-Period, 1, true},
+		{Period, 0, false},
+		{2 * Period, 1, false},
+	} {
+		ok, step, err := Verify(rfc6238Secret, passcode, time.Unix(v.unix+c.offset, 0), c.skew)
+		if err != nil {
+			t.Fatalf("Verify err: %v", err)
+		}
+		if ok != c.ok {
+			t.Errorf("Verify offset %v skew %v = %v, want %v", c.offset, c.skew, ok, c.ok)
+		}
+		if ok && step != v.step {
+			t.Errorf("Verify offset %v step = %v, want %v", c.offset, step, v.step)
+		}
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	now := time.Unix(59, 0)
+	for _, passcode := range []string{"", "28708", "2870820", "94287082", "287083"} {
+		ok, _, err := Verify(rfc6238Secret, passcode, now, 1)
+		if err != nil {
+			t.Fatalf("Verify(%q) err: %v", passcode, err)
+		}
+		if ok {
+			t.Errorf("Verify(%q) = true, want false", passcode)
+		}
+	}
+
+	if _, _, err := Verify("not base32!", "287082", now, 1); err == nil {
+		t.Error("Verify with malformed secret err = nil")
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := decodeSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != 20 {
+		t.Errorf("len(key) = %v, want 20", len(key))
+	}
+	// 导入的密钥可能带填充
+	if _, err = Code(secret+"====", time.Now()); err != nil {
+		t.Errorf("Code with padded secret err: %v", err)
+	}
+}
@@ -8,6 +8,9 @@ import (
 
 	sqlplus "github.com/cheetah-fun-gs/goplus/dao/sql"
 	mlogger "github.com/cheetah-fun-gs/goplus/multier/multilogger"
+	uuidplus "github.com/cheetah-fun-gs/goplus/uuid"
+	"github.com/cheetah-fun-gs/gouser/codesender"
+	"github.com/cheetah-fun-gs/gouser/tokenmgr"
 )
 
 // User 用户
@@ -41,9 +44,14 @@ type UserAuth struct {
 // UserAccessKey 访问密钥
 type UserAccessKey struct {
 	ID        int    `json:"id,omitempty"`
-	AccessKey string `json:"access_key,omitempty"`
+	KeyID     string `json:"key_id,omitempty"`     // 公开的密钥ID 用于 VerifySignByKeyID
+	AccessKey string `json:"access_key,omitempty"` // 密钥 仅 GenerateAccessKey 时返回明文, GetAccessKeys 只返回前4位
+	Scopes    Scopes `json:"scopes,omitempty"`     // 权限范围 为空表示拥有用户的全部权限
 	ExpireAt  int64  `json:"expire_at,omitempty"`
 	Comment   string `json:"comment,omitempty"`
+	LastUsed  int64  `json:"last_used,omitempty"` // 最后使用时间 为0表示从未使用
+	LastIP    string `json:"last_ip,omitempty"`   // 最后使用的IP
+	UseCount  int64  `json:"use_count,omitempty"` // 累计使用次数
 	Created   int64  `json:"created,omitempty"`
 }
 
@@ -52,9 +60,9 @@ func (user *User) Login() (token string, deadline int64, err error) {
 	return user.LoginWithFrom(fromDefault)
 }
 
-// LoginWithFrom 登录 带来源
-func (user *User) LoginWithFrom(from string) (token string, deadline int64, err error) {
-	token, deadline, err = user.mgr.tokenmgr.Generate(user.UID, from)
+// LoginWithFrom 登录 带来源 metas 可选的客户端信息, 用于会话列表
+func (user *User) LoginWithFrom(from string, metas ...*tokenmgr.SessionMeta) (token string, deadline int64, err error) {
+	token, deadline, err = user.mgr.tokenmgr.Generate(user.UID, from, metas...)
 	if err != nil {
 		return
 	}
@@ -75,16 +83,50 @@ func (user *User) LoginWithFrom(from string) (token string, deadline int64, err
 	return
 }
 
+// GenerateRefreshToken 生成刷新令牌 登录后用登录得到的token调用, 用于 UserMgr.RefreshToken
+// 刷新令牌绑定到token的会话, RevokeSession 注销会话时一并作废
+func (user *User) GenerateRefreshToken(token string) (refreshToken string, deadline int64, err error) {
+	return user.GenerateRefreshTokenWithFrom(fromDefault, token)
+}
+
+// GenerateRefreshTokenWithFrom 生成刷新令牌 带来源
+func (user *User) GenerateRefreshTokenWithFrom(from, token string) (refreshToken string, deadline int64, err error) {
+	var ok bool
+	if ok, err = user.mgr.tokenmgr.Verify(user.UID, from, token); err != nil {
+		return
+	} else if !ok {
+		err = ErrorTokenInvalid
+		return
+	}
+	return user.mgr.refreshmgr.Generate(user.UID, from, user.mgr.tokenmgr.SessionID(from, token))
+}
+
 // Logout 登出
 func (user *User) Logout() error {
 	return user.LogoutWithFrom(fromDefault)
 }
 
-// LogoutWithFrom 登出 带来源
+// LogoutWithFrom 登出 带来源 同时作废该来源的刷新令牌
 func (user *User) LogoutWithFrom(from string) error {
+	if err := user.mgr.refreshmgr.RevokeFrom(user.UID, from); err != nil {
+		return err
+	}
 	return user.mgr.tokenmgr.Clean(user.UID, from)
 }
 
+// GetSessions 获得有效的会话列表
+func (user *User) GetSessions() ([]*tokenmgr.Session, error) {
+	return user.mgr.tokenmgr.List(user.UID)
+}
+
+// RevokeSession 注销一个会话 如踢下线某个设备 同时作废该会话的刷新令牌
+func (user *User) RevokeSession(sessionID string) error {
+	if err := user.mgr.refreshmgr.RevokeSession(user.UID, sessionID); err != nil {
+		return err
+	}
+	return user.mgr.tokenmgr.Revoke(user.UID, sessionID)
+}
+
 // Clean 清除用户
 func (user *User) Clean() error {
 	var err error
@@ -98,14 +140,18 @@ func (user *User) Clean() error {
 			if cleanErr := user.mgr.tokenmgr.CleanAll(user.UID); cleanErr != nil {
 				mlogger.WarnN(user.mgr.mlogname, "tokenmgr.CleanAll %v err: %v", user.UID, cleanErr)
 			}
+			if cleanErr := user.mgr.refreshmgr.RevokeAll(user.UID); cleanErr != nil {
+				mlogger.WarnN(user.mgr.mlogname, "refreshmgr.RevokeAll %v err: %v", user.UID, cleanErr)
+			}
 		}
 	}()
 
 	query := fmt.Sprintf("DELETE FROM %v WHERE id = ?;", user.mgr.tableUser.Name)
 	args := []interface{}{user.ID}
 
-	// 不支持accesskey 和 第三方认证. 直接执行
-	if len(user.mgr.authMgrs) == 0 && !user.mgr.config.IsEnableAccessKey {
+	// 不支持accesskey 第三方认证 多因素认证 WebAuthn 和 历史密码. 直接执行
+	if len(user.mgr.authMgrs) == 0 && !user.mgr.config.IsEnableAccessKey && !user.mgr.config.IsEnableMFA &&
+		user.mgr.config.WebAuthn == nil && user.mgr.config.PasswordHistory <= 0 {
 		_, err := user.mgr.db.Exec(query, args...)
 		return err
 	}
@@ -154,13 +200,47 @@ func (user *User) Clean() error {
 		}
 	}
 
+	if user.mgr.config.IsEnableMFA {
+		queryMFA := fmt.Sprintf("DELETE FROM %v WHERE uid = ?;", user.mgr.tableUserMFA.Name)
+		argsMFA := []interface{}{user.UID}
+		_, err = tx.Exec(queryMFA, argsMFA...)
+		if err != nil {
+			return err
+		}
+
+		queryRecoveryCode := fmt.Sprintf("DELETE FROM %v WHERE uid = ?;", user.mgr.tableRecoveryCode.Name)
+		argsRecoveryCode := []interface{}{user.UID}
+		_, err = tx.Exec(queryRecoveryCode, argsRecoveryCode...)
+		if err != nil {
+			return err
+		}
+	}
+
+	if user.mgr.config.WebAuthn != nil {
+		queryWebAuthn := fmt.Sprintf("DELETE FROM %v WHERE uid = ?;", user.mgr.tableUserWebAuthn.Name)
+		argsWebAuthn := []interface{}{user.UID}
+		_, err = tx.Exec(queryWebAuthn, argsWebAuthn...)
+		if err != nil {
+			return err
+		}
+	}
+
+	if user.mgr.config.PasswordHistory > 0 {
+		queryPasswordHist := fmt.Sprintf("DELETE FROM %v WHERE uid = ?;", user.mgr.tablePasswordHist.Name)
+		argsPasswordHist := []interface{}{user.UID}
+		_, err = tx.Exec(queryPasswordHist, argsPasswordHist...)
+		if err != nil {
+			return err
+		}
+	}
+
 	if commitErr := tx.Commit(); commitErr != nil {
 		return commitErr
 	}
 
 	for _, ak := range aks {
-		if cleanErr := user.mgr.accessKeyCacher.Del(user.UID, ak.ID); err != nil {
-			mlogger.WarnN(user.mgr.mlogname, "accessKeyCacher.Del %v %v err: %v", user.UID, ak.ID, cleanErr)
+		if cleanErr := user.mgr.delAccessKeyCache(user.UID, ak.ID, ak.KeyID); cleanErr != nil {
+			mlogger.WarnN(user.mgr.mlogname, "delAccessKeyCache %v %v err: %v", user.UID, ak.ID, cleanErr)
 		}
 	}
 	return nil
@@ -300,19 +380,33 @@ func (user *User) UpdateUID(uid string) error {
 	return nil
 }
 
-// UpdateEmailApplyCode 更新邮箱申请验证码
-func (user *User) UpdateEmailApplyCode() (code string, expire int, err error) {
-	return user.mgr.ApplyCode(0, user.UID)
+// UpdateEmailApplyCode 更新邮箱申请验证码 超过限流返回 *RateLimitError
+func (user *User) UpdateEmailApplyCode(email string, metas ...*tokenmgr.SessionMeta) (code string, expire int, err error) {
+	if err = user.mgr.checkCodeRateLimit([]string{user.UID, email}, metas...); err != nil {
+		return
+	}
+	code, expire, _, err = user.mgr.applyPurposeCode(CodePurposeChangeEmail, "", user.UID, email)
+	return
 }
 
-// UpdateEmail 更新邮箱
+// UpdateEmailSendCode 更新邮箱申请验证码 并直接发送到新邮箱
+func (user *User) UpdateEmailSendCode(email string, meta *tokenmgr.SessionMeta, locales ...string) (expire int, err error) {
+	var code string
+	if code, expire, err = user.UpdateEmailApplyCode(email, meta); err != nil {
+		return
+	}
+	err = user.mgr.sendCode(codesender.ChannelEmail, email, CodeTemplateUpdateEmail, code, expire, locales...)
+	return
+}
+
+// UpdateEmail 更新邮箱 验证码与申请时的邮箱绑定
 func (user *User) UpdateEmail(email, code string) error {
-	ok, err := user.mgr.VerifyCode(code, user.UID)
+	ok, err := user.mgr.verifyPurposeCode(user.UID, "", code, CodePurposeChangeEmail, user.UID, email)
 	if err != nil {
 		return err
 	}
 	if !ok {
-		return fmt.Errorf("code is invalid")
+		return ErrorCodeInvalid
 	}
 
 	now := time.Now()
@@ -330,19 +424,32 @@ func (user *User) UpdateEmail(email, code string) error {
 	return nil
 }
 
-// UpdateMobileApplyCode 更新手机号申请验证码
-func (user *User) UpdateMobileApplyCode(mobile string) (code string, expire, retry int, err error) {
-	return user.mgr.ApplyCodeAntiReplay(mobile, 0, 0, user.UID)
+// UpdateMobileApplyCode 更新手机号申请验证码 超过限流返回 *RateLimitError
+func (user *User) UpdateMobileApplyCode(mobile string, metas ...*tokenmgr.SessionMeta) (code string, expire, retry int, err error) {
+	if err = user.mgr.checkCodeRateLimit([]string{user.UID, mobile}, metas...); err != nil {
+		return
+	}
+	return user.mgr.applyPurposeCode(CodePurposeChangeMobile, mobile, user.UID, mobile)
+}
+
+// UpdateMobileSendCode 更新手机号申请验证码 并直接发送到新手机号
+func (user *User) UpdateMobileSendCode(mobile string, meta *tokenmgr.SessionMeta, locales ...string) (expire, retry int, err error) {
+	var code string
+	if code, expire, retry, err = user.UpdateMobileApplyCode(mobile, meta); err != nil {
+		return
+	}
+	err = user.mgr.sendCode(codesender.ChannelSMS, mobile, CodeTemplateUpdateMobile, code, expire, locales...)
+	return
 }
 
-// UpdateMobile 更新手机号
+// UpdateMobile 更新手机号 验证码与申请时的手机号绑定
 func (user *User) UpdateMobile(mobile, code string) error {
-	ok, err := user.mgr.VerifyCode(code, user.UID)
+	ok, err := user.mgr.verifyPurposeCode(user.UID, "", code, CodePurposeChangeMobile, user.UID, mobile)
 	if err != nil {
 		return err
 	}
 	if !ok {
-		return fmt.Errorf("code is invalid")
+		return ErrorCodeInvalid
 	}
 
 	now := time.Now()
@@ -360,45 +467,90 @@ func (user *User) UpdateMobile(mobile, code string) error {
 	return nil
 }
 
-// UpdatePasswordApplyCode 更改密码申请验证码
-func (user *User) UpdatePasswordApplyCode() (code string, expire int, err error) {
-	return user.mgr.ApplyCode(0, user.UID)
+// UpdatePasswordApplyCode 更改密码申请验证码 超过限流返回 *RateLimitError
+func (user *User) UpdatePasswordApplyCode(metas ...*tokenmgr.SessionMeta) (code string, expire int, err error) {
+	// 验证码发送到用户邮箱, 没有邮箱时发送到手机
+	to := user.Email
+	if to == "" {
+		to = user.Mobile
+	}
+	if err = user.mgr.checkCodeRateLimit([]string{user.UID, to}, metas...); err != nil {
+		return
+	}
+	code, expire, _, err = user.mgr.applyPurposeCode(CodePurposeChangePassword, "", user.UID)
+	return
+}
+
+// UpdatePasswordSendCode 更改密码申请验证码 并直接发送到用户邮箱, 没有邮箱时发送到手机
+func (user *User) UpdatePasswordSendCode(meta *tokenmgr.SessionMeta, locales ...string) (expire int, err error) {
+	var channel, to string
+	if user.Email != "" {
+		channel, to = codesender.ChannelEmail, user.Email
+	} else if user.Mobile != "" {
+		channel, to = codesender.ChannelSMS, user.Mobile
+	} else {
+		err = fmt.Errorf("email and mobile are empty")
+		return
+	}
+
+	var code string
+	if code, expire, err = user.UpdatePasswordApplyCode(meta); err != nil {
+		return
+	}
+	err = user.mgr.sendCode(channel, to, CodeTemplateUpdatePassword, code, expire, locales...)
+	return
 }
 
-// UpdatePasswordWithCode 通过验证码更改密码
+// UpdatePasswordWithCode 通过验证码更改密码 密码不符合强度策略时返回 *PasswordPolicyError
+// 先校验验证码, 验证码正确后才校验新密码的强度和历史密码
 func (user *User) UpdatePasswordWithCode(rawPassword, code string) error {
-	ok, err := user.mgr.VerifyCode(code, user.UID)
+	validate := func() error {
+		return user.validatePassword(rawPassword)
+	}
+	ok, err := user.mgr.verifyPurposeCodeBefore(user.UID, "", code, CodePurposeChangePassword, validate, user.UID)
 	if err != nil {
 		return err
 	}
 	if !ok {
-		return fmt.Errorf("code is invalid")
+		return ErrorCodeInvalid
 	}
 
-	password := user.mgr.getPassword(rawPassword)
-	now := time.Now()
-	query := fmt.Sprintf("UPDATE %v Set password = ?, updated = ? WHERE id = ?;", user.mgr.tableUser.Name)
-	args := []interface{}{password, now, user.ID}
-	if _, err = sqlplus.RowsAffected(user.mgr.db.Exec(query, args...)); err != nil {
+	return user.setPassword(rawPassword)
+}
+
+// UpdatePasswordWithPassword 通过旧密码更改密码 密码不符合强度策略时返回 *PasswordPolicyError
+func (user *User) UpdatePasswordWithPassword(oldRawPassword, newRawPassword string) error {
+	if err := user.mgr.checkPassword(user.ID, oldRawPassword); err != nil {
 		return err
 	}
-	return nil
+	if err := user.validatePassword(newRawPassword); err != nil {
+		return err
+	}
+
+	return user.setPassword(newRawPassword)
 }
 
-// UpdatePasswordWithPassword 通过旧密码更改密码
-func (user *User) UpdatePasswordWithPassword(oldRawPassword, newRawPassword string) error {
-	oldPassword := user.mgr.getPassword(oldRawPassword)
-	newPassword := user.mgr.getPassword(newRawPassword)
+// setPassword 设置新密码
+func (user *User) setPassword(rawPassword string) error {
+	password, err := user.mgr.getPassword(rawPassword)
+	if err != nil {
+		return err
+	}
+
 	now := time.Now()
-	query := fmt.Sprintf("UPDATE %v Set password = ?, updated = ? WHERE id = ? AND password = ?;", user.mgr.tableUser.Name)
-	args := []interface{}{newPassword, now, user.ID, oldPassword}
-	if _, err := sqlplus.RowsAffected(user.mgr.db.Exec(query, args...)); err != nil {
+	query := fmt.Sprintf("UPDATE %v Set password = ?, password_changed = ?, updated = ? WHERE id = ?;", user.mgr.tableUser.Name)
+	args := []interface{}{password, now, now, user.ID}
+	if _, err = sqlplus.RowsAffected(user.mgr.db.Exec(query, args...)); err != nil {
 		return err
 	}
+
+	if errHistory := user.mgr.addPasswordHistory(user.UID, password, now); errHistory != nil {
+		mlogger.WarnN(user.mgr.mlogname, "addPasswordHistory %v err: %v", user.UID, errHistory)
+	}
 	return nil
 }
 
-// GetAccessKeys 获取accesskeys isAll 是否包含过期的访问秘钥
+// GetAccessKeys 获取accesskeys isAll 是否包含过期的访问秘钥 密钥只返回前4位
 func (user *User) GetAccessKeys(isAll bool) ([]*UserAccessKey, error) {
 	query := fmt.Sprintf("SELECT * FROM %v WHERE uid = ?", user.mgr.tableUserAccessKey.Name)
 	args := []interface{}{user.UID}
@@ -406,7 +558,20 @@ func (user *User) GetAccessKeys(isAll bool) ([]*UserAccessKey, error) {
 		query += " AND (expire_at is NULL OR expire_at > ?);"
 		args = append(args, time.Now())
 	}
+	return user.queryAccessKeys(query, args...)
+}
+
+// GetUnusedAccessKeys 获取超过 days 天未使用的accesskeys 从未使用过的按创建时间计算, 用于清理
+// 使用记录在 FlushAccessKeyUsage 后更新
+func (user *User) GetUnusedAccessKeys(days int) ([]*UserAccessKey, error) {
+	before := time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+	query := fmt.Sprintf("SELECT * FROM %v WHERE uid = ? AND (last_used < ? OR (last_used IS NULL AND created < ?));",
+		user.mgr.tableUserAccessKey.Name)
+	args := []interface{}{user.UID, before, before}
+	return user.queryAccessKeys(query, args...)
+}
 
+func (user *User) queryAccessKeys(query string, args ...interface{}) ([]*UserAccessKey, error) {
 	rows, err := user.mgr.db.Query(query, args...)
 	if err != nil {
 		return nil, err
@@ -420,25 +585,47 @@ func (user *User) GetAccessKeys(isAll bool) ([]*UserAccessKey, error) {
 
 	accessKeys := []*UserAccessKey{}
 	for _, val := range result {
-		var expireAt int64
+		var expireAt, lastUsed int64
 		if val.ExpireAt.Valid {
 			expireAt = val.ExpireAt.Time.Unix()
 		}
+		if val.LastUsed.Valid {
+			lastUsed = val.LastUsed.Time.Unix()
+		}
+		accessKey, _, err := user.mgr.openAccessKey(val.KeyID, val.AccessKey)
+		if err != nil {
+			mlogger.WarnN(user.mgr.mlogname, "openAccessKey %v %v err: %v", user.UID, val.ID, err)
+		}
 		accessKeys = append(accessKeys, &UserAccessKey{
 			ID:        val.ID,
-			AccessKey: val.AccessKey,
+			KeyID:     val.KeyID,
+			AccessKey: maskAccessKey(accessKey),
+			Scopes:    parseScopes(val.Scopes),
 			ExpireAt:  expireAt,
 			Comment:   val.Comment,
+			LastUsed:  lastUsed,
+			LastIP:    val.LastIP,
+			UseCount:  val.UseCount,
 			Created:   val.Created.Unix(),
 		})
 	}
 	return accessKeys, nil
 }
 
-// GenerateAccessKey 生成一个 access key
+// GenerateAccessKey 生成一个 access key 密钥明文只在此时返回一次, 加密后存储
 func (user *User) GenerateAccessKey(comment string, expireAts ...time.Time) (*UserAccessKey, error) {
+	return user.GenerateScopedAccessKey(comment, nil, expireAts...)
+}
+
+// GenerateScopedAccessKey 生成一个限定权限范围的 access key scopes 为空表示拥有用户的全部权限
+func (user *User) GenerateScopedAccessKey(comment string, scopes Scopes, expireAts ...time.Time) (*UserAccessKey, error) {
 	now := time.Now()
 
+	scopesArg, err := formatScopes(scopes)
+	if err != nil {
+		return nil, err
+	}
+
 	expireAt := sql.NullTime{}
 	if len(expireAts) > 0 {
 		if expireAt.Time.Before(now) {
@@ -447,10 +634,17 @@ func (user *User) GenerateAccessKey(comment string, expireAts ...time.Time) (*Us
 		expireAt.Valid = true
 		expireAt.Time = expireAts[0]
 	}
+	keyID := uuidplus.NewV4().Base62()
 	accessKey := user.mgr.generateAccessKey()
+	sealed, err := user.mgr.sealAccessKey(keyID, accessKey)
+	if err != nil {
+		return nil, err
+	}
 	data := &ModelUserAccessKey{
-		AccessKey: accessKey,
+		KeyID:     keyID,
+		AccessKey: sealed,
 		UID:       user.UID,
+		Scopes:    scopesArg,
 		Comment:   comment,
 		ExpireAt:  expireAt,
 		Created:   now,
@@ -464,7 +658,9 @@ func (user *User) GenerateAccessKey(comment string, expireAts ...time.Time) (*Us
 
 	userAccessKey := &UserAccessKey{
 		ID:        int(aid),
+		KeyID:     keyID,
 		AccessKey: accessKey,
+		Scopes:    parseScopes(scopesArg),
 		Comment:   comment,
 		Created:   now.Unix(),
 	}
@@ -488,16 +684,38 @@ func (user *User) UpdateAccessKeyComment(accessKeyID int, comment string) error
 	return nil
 }
 
+// UpdateAccessKeyScopes 更新一个 access key 的权限范围 scopes 为空表示拥有用户的全部权限
+func (user *User) UpdateAccessKeyScopes(accessKeyID int, scopes Scopes) error {
+	scopesArg, err := formatScopes(scopes)
+	if err != nil {
+		return err
+	}
+	keyID, err := user.getAccessKeyID(accessKeyID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	query := fmt.Sprintf("UPDATE %v Set scopes = ?, updated = ? WHERE id = ? AND uid = ?;", user.mgr.tableUserAccessKey.Name)
+	args := []interface{}{scopesArg, now, accessKeyID, user.UID}
+	if _, err = sqlplus.RowsAffected(user.mgr.db.Exec(query, args...)); err != nil {
+		return err
+	}
+
+	// 缓存中有权限范围 立即删除
+	return user.mgr.delAccessKeyCache(user.UID, accessKeyID, keyID)
+}
+
 // UpdateAccessKeyExpireAt 更新一个 access key的超时设置 expireAt为 nil 表示永久有效
 func (user *User) UpdateAccessKeyExpireAt(accessKeyID int, expireAt *time.Time) error {
 	now := time.Now()
-	query := fmt.Sprintf("UPDATE %v Set expire_at = ?, updated = ? WHERE id = ?;", user.mgr.tableUserAccessKey.Name)
+	query := fmt.Sprintf("UPDATE %v Set expire_at = ?, updated = ? WHERE id = ? AND uid = ?;", user.mgr.tableUserAccessKey.Name)
 	expireAtArg := sql.NullTime{}
 	if expireAt != nil {
 		expireAtArg.Valid = true
 		expireAtArg.Time = *expireAt
 	}
-	args := []interface{}{expireAtArg, now, accessKeyID}
+	args := []interface{}{expireAtArg, now, accessKeyID, user.UID}
 	updateCount, err := sqlplus.RowsAffected(user.mgr.db.Exec(query, args...))
 	if err != nil {
 		return err
@@ -508,7 +726,11 @@ func (user *User) UpdateAccessKeyExpireAt(accessKeyID int, expireAt *time.Time)
 
 	// 失效删除缓存 生效的等自然回源
 	if expireAt != nil && expireAt.Before(now) {
-		if err = user.mgr.accessKeyCacher.Del(user.UID, accessKeyID); err != nil {
+		var keyID string
+		if keyID, err = user.getAccessKeyID(accessKeyID); err != nil {
+			return err
+		}
+		if err = user.mgr.delAccessKeyCache(user.UID, accessKeyID, keyID); err != nil {
 			return err
 		}
 	}
@@ -517,15 +739,33 @@ func (user *User) UpdateAccessKeyExpireAt(accessKeyID int, expireAt *time.Time)
 
 // DeleteAccessKey 删除一个 access key
 func (user *User) DeleteAccessKey(accessKeyID int) error {
-	query := fmt.Sprintf("DELETE FROM %v WHERE id = ?;", user.mgr.tableUserAccessKey.Name)
-	args := []interface{}{accessKeyID}
-	if _, err := sqlplus.RowsAffected(user.mgr.db.Exec(query, args...)); err != nil {
+	keyID, err := user.getAccessKeyID(accessKeyID)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("DELETE FROM %v WHERE id = ? AND uid = ?;", user.mgr.tableUserAccessKey.Name)
+	args := []interface{}{accessKeyID, user.UID}
+	if _, err = sqlplus.RowsAffected(user.mgr.db.Exec(query, args...)); err != nil {
 		return err
 	}
 
 	// 从缓存里删除
-	if err := user.mgr.accessKeyCacher.Del(user.UID, accessKeyID); err != nil {
+	if err = user.mgr.delAccessKeyCache(user.UID, accessKeyID, keyID); err != nil {
 		return err
 	}
 	return nil
 }
+
+// getAccessKeyID 获得访问密钥公开的密钥ID
+func (user *User) getAccessKeyID(accessKeyID int) (string, error) {
+	var keyID string
+	query := fmt.Sprintf("SELECT key_id FROM %v WHERE id = ? AND uid = ?;", user.mgr.tableUserAccessKey.Name)
+	args := []interface{}{accessKeyID, user.UID}
+	if err := user.mgr.db.QueryRow(query, args...).Scan(&keyID); err == sql.ErrNoRows {
+		return "", ErrorNotFound
+	} else if err != nil {
+		return "", err
+	}
+	return keyID, nil
+}
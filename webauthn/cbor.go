@@ -0,0 +1,127 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// 仅实现 WebAuthn 需要的 CBOR 子集(RFC 8949): 定长的整数、字节串、文本串、数组、映射和简单值
+// 整数统一解码为 int64, 映射解码为 map[interface{}]interface{}
+
+// 最大嵌套深度 防止恶意数据
+const cborMaxDepth = 16
+
+// cborDecode 解码一个数据项 返回剩余的字节
+func cborDecode(data []byte) (interface{}, []byte, error) {
+	return cborDecodeDepth(data, 0)
+}
+
+func cborReadArg(data []byte, info byte) (uint64, []byte, error) {
+	switch {
+	case info < 24:
+		return uint64(info), data, nil
+	case info == 24:
+		if len(data) < 1 {
+			return 0, nil, ErrorCBOR
+		}
+		return uint64(data[0]), data[1:], nil
+	case info == 25:
+		if len(data) < 2 {
+			return 0, nil, ErrorCBOR
+		}
+		return uint64(binary.BigEndian.Uint16(data)), data[2:], nil
+	case info == 26:
+		if len(data) < 4 {
+			return 0, nil, ErrorCBOR
+		}
+		return uint64(binary.BigEndian.Uint32(data)), data[4:], nil
+	case info == 27:
+		if len(data) < 8 {
+			return 0, nil, ErrorCBOR
+		}
+		return binary.BigEndian.Uint64(data), data[8:], nil
+	}
+	// 不支持不定长编码
+	return 0, nil, ErrorCBOR
+}
+
+func cborDecodeDepth(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > cborMaxDepth || len(data) == 0 {
+		return nil, nil, ErrorCBOR
+	}
+
+	major, info := data[0]>>5, data[0]&0x1f
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data[1:], nil
+		case 21:
+			return true, data[1:], nil
+		case 22, 23:
+			return nil, data[1:], nil
+		}
+		return nil, nil, fmt.Errorf("%w: simple value %v is not support", ErrorCBOR, info)
+	}
+
+	arg, rest, err := cborReadArg(data[1:], info)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, ErrorCBOR
+		}
+		return int64(arg), rest, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, ErrorCBOR
+		}
+		return -1 - int64(arg), rest, nil
+	case 2, 3:
+		if arg > uint64(len(rest)) {
+			return nil, nil, ErrorCBOR
+		}
+		if major == 2 {
+			return rest[:arg], rest[arg:], nil
+		}
+		return string(rest[:arg]), rest[arg:], nil
+	case 4:
+		if arg > uint64(len(rest)) {
+			return nil, nil, ErrorCBOR
+		}
+		result := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item interface{}
+			if item, rest, err = cborDecodeDepth(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			result = append(result, item)
+		}
+		return result, rest, nil
+	case 5:
+		if arg > uint64(len(rest)) {
+			return nil, nil, ErrorCBOR
+		}
+		result := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, val interface{}
+			if key, rest, err = cborDecodeDepth(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("%w: map key type %T is not support", ErrorCBOR, key)
+			}
+			if val, rest, err = cborDecodeDepth(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			result[key] = val
+		}
+		return result, rest, nil
+	}
+	return nil, nil, fmt.Errorf("%w: major type %v is not support", ErrorCBOR, major)
+}
@@ -0,0 +1,102 @@
+package webauthn
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCBORDecode(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want interface{}
+		rest []byte
+	}{
+		{name: "uint", data: []byte{0x17}, want: int64(23)},
+		{name: "uint8", data: []byte{0x18, 0x18}, want: int64(24)},
+		{name: "uint16", data: []byte{0x19, 0x01, 0x00}, want: int64(256)},
+		{name: "uint32", data: []byte{0x1a, 0x00, 0x01, 0x00, 0x00}, want: int64(65536)},
+		{name: "uint64", data: []byte{0x1b, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, want: int64(1<<63 - 1)},
+		{name: "negative", data: []byte{0x26}, want: int64(-7)},
+		{name: "negative16", data: []byte{0x39, 0x01, 0x00}, want: int64(-257)},
+		{name: "bytes", data: []byte{0x42, 0x01, 0x02}, want: []byte{0x01, 0x02}},
+		{name: "text", data: []byte{0x63, 'f', 'm', 't'}, want: "fmt"},
+		{name: "array", data: []byte{0x82, 0x01, 0x20}, want: []interface{}{int64(1), int64(-1)}},
+		{name: "map", data: []byte{0xa2, 0x01, 0x02, 0x61, 'a', 0xf5}, want: map[interface{}]interface{}{int64(1): int64(2), "a": true}},
+		{name: "false", data: []byte{0xf4}, want: false},
+		{name: "null", data: []byte{0xf6}, want: nil},
+		{name: "rest", data: []byte{0x01, 0x02, 0x03}, want: int64(1), rest: []byte{0x02, 0x03}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, rest, err := cborDecode(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(v, tt.want) {
+				t.Fatalf("v = %#v, want %#v", v, tt.want)
+			}
+			if !bytes.Equal(rest, tt.rest) {
+				t.Fatalf("rest = %x, want %x", rest, tt.rest)
+			}
+		})
+	}
+}
+
+func TestCBORDecodeMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: []byte{}},
+		{name: "truncated uint8", data: []byte{0x18}},
+		{name: "truncated uint16", data: []byte{0x19, 0x01}},
+		{name: "truncated uint32", data: []byte{0x1a, 0x00, 0x01, 0x00}},
+		{name: "truncated uint64", data: []byte{0x1b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01}},
+		{name: "reserved additional info", data: []byte{0x1c}},
+		{name: "uint overflow", data: []byte{0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{name: "negative overflow", data: []byte{0x3b, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{name: "truncated bytes", data: []byte{0x43, 0x01, 0x02}},
+		{name: "huge bytes length", data: []byte{0x5b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{name: "truncated text", data: []byte{0x63, 'f', 'm'}},
+		{name: "indefinite bytes", data: []byte{0x5f, 0x41, 0x01, 0xff}},
+		{name: "indefinite array", data: []byte{0x9f, 0x01, 0xff}},
+		{name: "truncated array", data: []byte{0x82, 0x01}},
+		{name: "huge array length", data: []byte{0x9a, 0xff, 0xff, 0xff, 0xff}},
+		{name: "truncated map", data: []byte{0xa2, 0x01, 0x02, 0x03}},
+		{name: "map missing value", data: []byte{0xa1, 0x01}},
+		{name: "map bytes key", data: []byte{0xa1, 0x41, 0x01, 0x02}},
+		{name: "map array key", data: []byte{0xa1, 0x80, 0x02}},
+		{name: "tag", data: []byte{0xc0, 0x61, 'a'}},
+		{name: "float", data: []byte{0xf9, 0x3c, 0x00}},
+		{name: "undefined simple", data: []byte{0xe0}},
+		{name: "too deep", data: append(bytes.Repeat([]byte{0x81}, cborMaxDepth+1), 0x01)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if v, _, err := cborDecode(tt.data); !errors.Is(err, ErrorCBOR) {
+				t.Fatalf("v = %#v err = %v, want %v", v, err, ErrorCBOR)
+			}
+		})
+	}
+}
+
+func TestCBORDecodeTruncatedFixtures(t *testing.T) {
+	for _, fixture := range []string{"packed_self_macos.json", "none_titan.json", "tpm_rs256_windows_hello.json"} {
+		response := &AttestationResponse{}
+		loadFixture(t, fixture, response)
+		data := mustDecode(t, response.Response.AttestationObject)
+		if _, rest, err := cborDecode(data); err != nil || len(rest) > 0 {
+			t.Fatalf("%v: rest = %v err = %v", fixture, len(rest), err)
+		}
+		for i := 0; i < len(data); i++ {
+			if _, _, err := cborDecode(data[:i]); !errors.Is(err, ErrorCBOR) {
+				t.Fatalf("%v: truncated to %v bytes: err = %v, want %v", fixture, i, err, ErrorCBOR)
+			}
+		}
+	}
+}
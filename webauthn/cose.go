@@ -0,0 +1,153 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// COSE 算法 RFC 8152
+const (
+	AlgES256 = -7   // ECDSA P-256 SHA-256
+	AlgEdDSA = -8   // Ed25519
+	AlgRS256 = -257 // RSASSA-PKCS1-v1_5 SHA-256
+)
+
+// COSE key 参数
+const (
+	coseKty = 1
+	coseAlg = 3
+	coseCrv = -1 // EC2/OKP 曲线; RSA 为 n
+	coseX   = -2 // EC2/OKP x; RSA 为 e
+	coseY   = -3
+
+	coseKtyOKP = 1
+	coseKtyEC2 = 2
+	coseKtyRSA = 3
+
+	coseCrvP256    = 1
+	coseCrvEd25519 = 6
+)
+
+// PublicKey 凭证公钥
+type PublicKey struct {
+	Algorithm int
+	Key       crypto.PublicKey // *ecdsa.PublicKey *rsa.PublicKey 或 ed25519.PublicKey
+}
+
+func coseInt(m map[interface{}]interface{}, key int64) (int64, bool) {
+	val, ok := m[key].(int64)
+	return val, ok
+}
+
+func coseBytes(m map[interface{}]interface{}, key int64) ([]byte, bool) {
+	val, ok := m[key].([]byte)
+	return val, ok
+}
+
+// ParsePublicKey 解析 COSE 格式公钥
+func ParsePublicKey(data []byte) (*PublicKey, error) {
+	key, _, err := parsePublicKey(data)
+	return key, err
+}
+
+// parsePublicKey 解析 COSE 格式公钥 返回剩余的字节
+func parsePublicKey(data []byte) (*PublicKey, []byte, error) {
+	v, rest, err := cborDecode(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, nil, ErrorPublicKey
+	}
+
+	kty, ok1 := coseInt(m, coseKty)
+	alg, ok2 := coseInt(m, coseAlg)
+	if !ok1 || !ok2 {
+		return nil, nil, ErrorPublicKey
+	}
+
+	switch {
+	case kty == coseKtyEC2 && alg == AlgES256:
+		crv, _ := coseInt(m, coseCrv)
+		x, okX := coseBytes(m, coseX)
+		y, okY := coseBytes(m, coseY)
+		if crv != coseCrvP256 || !okX || !okY || len(x) != 32 || len(y) != 32 {
+			return nil, nil, ErrorPublicKey
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, nil, ErrorPublicKey
+		}
+		return &PublicKey{Algorithm: AlgES256, Key: pub}, rest, nil
+	case kty == coseKtyRSA && alg == AlgRS256:
+		n, okN := coseBytes(m, coseCrv)
+		e, okE := coseBytes(m, coseX)
+		if !okN || !okE || len(e) == 0 || len(e) > 4 || len(n) < 256 {
+			return nil, nil, ErrorPublicKey
+		}
+		// 公钥指数必须是不小于3的奇数, 且不超过 crypto/rsa 支持的范围
+		exponent := new(big.Int).SetBytes(e).Int64()
+		if exponent < 3 || exponent%2 == 0 || exponent > math.MaxInt32 {
+			return nil, nil, ErrorPublicKey
+		}
+		pub := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(exponent),
+		}
+		return &PublicKey{Algorithm: AlgRS256, Key: pub}, rest, nil
+	case kty == coseKtyOKP && alg == AlgEdDSA:
+		crv, _ := coseInt(m, coseCrv)
+		x, okX := coseBytes(m, coseX)
+		if crv != coseCrvEd25519 || !okX || len(x) != ed25519.PublicKeySize {
+			return nil, nil, ErrorPublicKey
+		}
+		return &PublicKey{Algorithm: AlgEdDSA, Key: ed25519.PublicKey(x)}, rest, nil
+	}
+	return nil, nil, fmt.Errorf("%w: kty %v alg %v is not support", ErrorPublicKey, kty, alg)
+}
+
+// Verify 校验签名
+func (key *PublicKey) Verify(data, signature []byte) bool {
+	switch key.Algorithm {
+	case AlgES256:
+		pub, ok := key.Key.(*ecdsa.PublicKey)
+		if !ok {
+			return false
+		}
+		sig := &struct {
+			R, S *big.Int
+		}{}
+		if rest, err := asn1.Unmarshal(signature, sig); err != nil || len(rest) > 0 {
+			return false
+		}
+		digest := sha256.Sum256(data)
+		return ecdsa.Verify(pub, digest[:], sig.R, sig.S)
+	case AlgRS256:
+		pub, ok := key.Key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		digest := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) == nil
+	case AlgEdDSA:
+		pub, ok := key.Key.(ed25519.PublicKey)
+		if !ok {
+			return false
+		}
+		return ed25519.Verify(pub, data, signature)
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"errors"
+	"testing"
+)
+
+// rsaCOSEKey 构造 RS256 COSE 公钥 {1: 3, 3: -257, -1: n, -2: e}
+func rsaCOSEKey(n, e []byte) []byte {
+	buf := &bytes.Buffer{}
+	buf.Write([]byte{0xa4, 0x01, 0x03, 0x03, 0x39, 0x01, 0x00})
+	buf.Write([]byte{0x20, 0x59, byte(len(n) >> 8), byte(len(n))})
+	buf.Write(n)
+	buf.Write([]byte{0x21, 0x40 | byte(len(e))})
+	buf.Write(e)
+	return buf.Bytes()
+}
+
+func TestParsePublicKeyRSAExponent(t *testing.T) {
+	n := bytes.Repeat([]byte{0xc5}, 256)
+
+	tests := []struct {
+		name string
+		e    []byte
+		want int
+		err  error
+	}{
+		{name: "65537", e: []byte{0x01, 0x00, 0x01}, want: 65537},
+		{name: "3", e: []byte{0x03}, want: 3},
+		{name: "max int32", e: []byte{0x7f, 0xff, 0xff, 0xff}, want: 1<<31 - 1},
+		{name: "empty", e: []byte{}, err: ErrorPublicKey},
+		{name: "0", e: []byte{0x00}, err: ErrorPublicKey},
+		{name: "1", e: []byte{0x01}, err: ErrorPublicKey},
+		{name: "even", e: []byte{0x01, 0x00, 0x00}, err: ErrorPublicKey},
+		{name: "over int32", e: []byte{0xff, 0xff, 0xff, 0xff}, err: ErrorPublicKey},
+		{name: "too long", e: []byte{0x00, 0x00, 0x01, 0x00, 0x01}, err: ErrorPublicKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := ParsePublicKey(rsaCOSEKey(n, tt.e))
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e := key.Key.(*rsa.PublicKey).E; e != tt.want {
+				t.Fatalf("e = %v, want %v", e, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	touchID := mustDecode(t, touchIDPublicKey)
+
+	tests := []struct {
+		name string
+		data []byte
+		alg  int
+		err  error
+	}{
+		{name: "ES256", data: touchID, alg: AlgES256},
+		{name: "RS256 modulus too short", data: rsaCOSEKey(bytes.Repeat([]byte{0xc5}, 128), []byte{0x01, 0x00, 0x01}), err: ErrorPublicKey},
+		{name: "ES256 point not on curve", data: func() []byte {
+			data := append([]byte{}, touchID...)
+			data[len(data)-1] ^= 0x01 // y 的最后一个字节
+			return data
+		}(), err: ErrorPublicKey},
+		{name: "not a map", data: []byte{0x80}, err: ErrorPublicKey},
+		{name: "missing alg", data: []byte{0xa1, 0x01, 0x02}, err: ErrorPublicKey},
+		{name: "unsupported alg", data: []byte{0xa2, 0x01, 0x02, 0x03, 0x38, 0x22}, err: ErrorPublicKey},
+		{name: "truncated", data: touchID[:len(touchID)-1], err: ErrorCBOR},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := ParsePublicKey(tt.data)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key.Algorithm != tt.alg {
+				t.Fatalf("alg = %v, want %v", key.Algorithm, tt.alg)
+			}
+		})
+	}
+}
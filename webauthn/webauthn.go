@@ -0,0 +1,420 @@
+// Package webauthn WebAuthn 依赖方(relying party) 的最小实现
+// 支持 ES256/RS256/EdDSA 凭证; 不校验证明(attestation)的信任链, 即按 attestation "none" 处理
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+// 常用错误
+var (
+	ErrorCBOR        = fmt.Errorf("cbor is invalid")
+	ErrorPublicKey   = fmt.Errorf("public key is invalid")
+	ErrorClientData  = fmt.Errorf("client data is invalid")
+	ErrorAuthData    = fmt.Errorf("authenticator data is invalid")
+	ErrorSignature   = fmt.Errorf("signature is invalid")
+	ErrorSignCount   = fmt.Errorf("sign count is invalid")
+	ErrorNotPresent  = fmt.Errorf("user not present")
+	ErrorNotVerified = fmt.Errorf("user not verified")
+)
+
+// 用户验证要求
+const (
+	UserVerificationRequired    = "required"
+	UserVerificationPreferred   = "preferred"
+	UserVerificationDiscouraged = "discouraged"
+)
+
+// authenticator data 标志位
+const (
+	flagUP = 0x01 // 用户在场
+	flagUV = 0x04 // 用户已验证
+	flagAT = 0x40 // 包含凭证数据
+	flagED = 0x80 // 包含扩展数据
+)
+
+// Encoding 二进制字段在 JSON 中的编码
+var Encoding = base64.RawURLEncoding
+
+// Config 依赖方配置
+type Config struct {
+	RPID             string   // 依赖方ID 一般是域名, 如 example.com
+	RPName           string   // 依赖方名称 显示给用户
+	Origins          []string // 允许的来源 如 https://example.com
+	Timeout          int      // 仪式超时时间 秒
+	UserVerification string   // 用户验证要求 默认 preferred
+}
+
+// RelyingParty 依赖方
+type RelyingParty struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name"`
+}
+
+// UserEntity 用户
+type UserEntity struct {
+	ID          string `json:"id"` // base64url
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+// CredentialParameter 支持的凭证算法
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+// CredentialDescriptor 凭证描述
+type CredentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"` // base64url
+	Transports []string `json:"transports,omitempty"`
+}
+
+// AuthenticatorSelection 认证器要求
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey,omitempty"`
+	UserVerification string `json:"userVerification,omitempty"`
+}
+
+// CreationOptions 注册选项 对应 PublicKeyCredentialCreationOptions, 二进制字段为 base64url
+type CreationOptions struct {
+	Challenge              string                  `json:"challenge"`
+	RP                     RelyingParty            `json:"rp"`
+	User                   UserEntity              `json:"user"`
+	PubKeyCredParams       []CredentialParameter   `json:"pubKeyCredParams"`
+	Timeout                int                     `json:"timeout,omitempty"` // 毫秒
+	ExcludeCredentials     []CredentialDescriptor  `json:"excludeCredentials,omitempty"`
+	AuthenticatorSelection *AuthenticatorSelection `json:"authenticatorSelection,omitempty"`
+	Attestation            string                  `json:"attestation,omitempty"`
+}
+
+// RequestOptions 登录选项 对应 PublicKeyCredentialRequestOptions, 二进制字段为 base64url
+type RequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	RPID             string                 `json:"rpId,omitempty"`
+	Timeout          int                    `json:"timeout,omitempty"` // 毫秒
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials,omitempty"`
+	UserVerification string                 `json:"userVerification,omitempty"`
+}
+
+// AttestationResponse 注册结果 由客户端 navigator.credentials.create 得到, 二进制字段为 base64url
+type AttestationResponse struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string   `json:"clientDataJSON"`
+		AttestationObject string   `json:"attestationObject"`
+		Transports        []string `json:"transports,omitempty"`
+	} `json:"response"`
+}
+
+// AssertionResponse 登录结果 由客户端 navigator.credentials.get 得到, 二进制字段为 base64url
+type AssertionResponse struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle,omitempty"`
+	} `json:"response"`
+}
+
+// ClientData 客户端数据
+type ClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// Credential 注册成功的凭证
+type Credential struct {
+	ID        []byte // 凭证ID
+	PublicKey []byte // COSE 格式公钥
+	Algorithm int    // COSE 算法
+	SignCount uint32 // 签名计数
+	AAGUID    []byte // 认证器型号
+}
+
+// RelyingPartyMgr 依赖方
+type RelyingPartyMgr struct {
+	config *Config
+}
+
+// New 获得一个依赖方
+func New(config *Config) *RelyingPartyMgr {
+	if config.Timeout == 0 {
+		config.Timeout = 300
+	}
+	if config.UserVerification == "" {
+		config.UserVerification = UserVerificationPreferred
+	}
+	return &RelyingPartyMgr{config: config}
+}
+
+// GetTimeout 仪式超时时间 秒
+func (rp *RelyingPartyMgr) GetTimeout() int {
+	return rp.config.Timeout
+}
+
+// NewChallenge 生成一个随机挑战 base64url
+func NewChallenge() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return Encoding.EncodeToString(buf), nil
+}
+
+// CreationOptions 生成注册选项 userID 为用户句柄, 登录时作为 userHandle 返回
+func (rp *RelyingPartyMgr) CreationOptions(challenge string, userID []byte, name, displayName string, excludes ...[]byte) *CreationOptions {
+	options := &CreationOptions{
+		Challenge: challenge,
+		RP: RelyingParty{
+			ID:   rp.config.RPID,
+			Name: rp.config.RPName,
+		},
+		User: UserEntity{
+			ID:          Encoding.EncodeToString(userID),
+			Name:        name,
+			DisplayName: displayName,
+		},
+		PubKeyCredParams: []CredentialParameter{
+			{Type: "public-key", Alg: AlgES256},
+			{Type: "public-key", Alg: AlgEdDSA},
+			{Type: "public-key", Alg: AlgRS256},
+		},
+		Timeout: rp.config.Timeout * 1000,
+		AuthenticatorSelection: &AuthenticatorSelection{
+			ResidentKey:      "preferred",
+			UserVerification: rp.config.UserVerification,
+		},
+		Attestation: "none",
+	}
+	for _, id := range excludes {
+		options.ExcludeCredentials = append(options.ExcludeCredentials, CredentialDescriptor{
+			Type: "public-key",
+			ID:   Encoding.EncodeToString(id),
+		})
+	}
+	return options
+}
+
+// RequestOptions 生成登录选项 allows 为空时由认证器选择可发现凭证(passkey)
+func (rp *RelyingPartyMgr) RequestOptions(challenge string, allows ...[]byte) *RequestOptions {
+	options := &RequestOptions{
+		Challenge:        challenge,
+		RPID:             rp.config.RPID,
+		Timeout:          rp.config.Timeout * 1000,
+		UserVerification: rp.config.UserVerification,
+	}
+	for _, id := range allows {
+		options.AllowCredentials = append(options.AllowCredentials, CredentialDescriptor{
+			Type: "public-key",
+			ID:   Encoding.EncodeToString(id),
+		})
+	}
+	return options
+}
+
+// ParseClientData 解析客户端数据 用于取出挑战
+func ParseClientData(clientDataJSON []byte) (*ClientData, error) {
+	clientData := &ClientData{}
+	if err := json.Unmarshal(clientDataJSON, clientData); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrorClientData, err)
+	}
+	return clientData, nil
+}
+
+func (rp *RelyingPartyMgr) checkClientData(clientData *ClientData, typ, challenge string) error {
+	if clientData.Type != typ {
+		return fmt.Errorf("%w: type %v", ErrorClientData, clientData.Type)
+	}
+	if clientData.Challenge != challenge {
+		return fmt.Errorf("%w: challenge mismatch", ErrorClientData)
+	}
+	for _, origin := range rp.config.Origins {
+		if clientData.Origin == origin {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: origin %v", ErrorClientData, clientData.Origin)
+}
+
+type authData struct {
+	rpIDHash   []byte
+	flags      byte
+	signCount  uint32
+	credential *Credential
+}
+
+// parseAuthData 解析 authenticator data
+func parseAuthData(data []byte) (*authData, error) {
+	if len(data) < 37 {
+		return nil, ErrorAuthData
+	}
+	result := &authData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+
+	rest := data[37:]
+	if result.flags&flagAT != 0 {
+		if len(rest) < 18 {
+			return nil, ErrorAuthData
+		}
+		aaguid := rest[:16]
+		idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLen > len(rest) {
+			return nil, ErrorAuthData
+		}
+		credentialID := rest[:idLen]
+		rest = rest[idLen:]
+
+		key, keyRest, err := parsePublicKey(rest)
+		if err != nil {
+			return nil, err
+		}
+		result.credential = &Credential{
+			ID:        credentialID,
+			PublicKey: rest[:len(rest)-len(keyRest)],
+			Algorithm: key.Algorithm,
+			SignCount: result.signCount,
+			AAGUID:    aaguid,
+		}
+		rest = keyRest
+	}
+	if result.flags&flagED != 0 {
+		_, extRest, err := cborDecode(rest)
+		if err != nil {
+			return nil, err
+		}
+		rest = extRest
+	}
+	if len(rest) > 0 {
+		return nil, ErrorAuthData
+	}
+	return result, nil
+}
+
+func (rp *RelyingPartyMgr) checkAuthData(data *authData) error {
+	rpIDHash := sha256.Sum256([]byte(rp.config.RPID))
+	if !bytes.Equal(data.rpIDHash, rpIDHash[:]) {
+		return fmt.Errorf("%w: rp id mismatch", ErrorAuthData)
+	}
+	if data.flags&flagUP == 0 {
+		return ErrorNotPresent
+	}
+	if rp.config.UserVerification == UserVerificationRequired && data.flags&flagUV == 0 {
+		return ErrorNotVerified
+	}
+	return nil
+}
+
+func decodeFields(fields ...string) ([][]byte, error) {
+	result := [][]byte{}
+	for _, field := range fields {
+		data, err := Encoding.DecodeString(field)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, data)
+	}
+	return result, nil
+}
+
+// VerifyRegistration 校验注册结果 challenge 为 CreationOptions 中的挑战
+func (rp *RelyingPartyMgr) VerifyRegistration(challenge string, response *AttestationResponse) (*Credential, error) {
+	fields, err := decodeFields(response.Response.ClientDataJSON, response.Response.AttestationObject)
+	if err != nil {
+		return nil, err
+	}
+
+	clientData, err := ParseClientData(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	if err = rp.checkClientData(clientData, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	v, _, err := cborDecode(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	attestation, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrorCBOR
+	}
+	if _, ok = attestation["fmt"].(string); !ok {
+		return nil, ErrorCBOR
+	}
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return nil, ErrorCBOR
+	}
+
+	data, err := parseAuthData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if err = rp.checkAuthData(data); err != nil {
+		return nil, err
+	}
+	if data.credential == nil {
+		return nil, fmt.Errorf("%w: no attested credential", ErrorAuthData)
+	}
+	return data.credential, nil
+}
+
+// VerifyAssertion 校验登录结果 challenge 为 RequestOptions 中的挑战
+// publicKey 和 signCount 为注册时保存的凭证公钥和最近的签名计数, 返回新的签名计数
+// 认证器支持计数时, 计数未增加视为凭证被克隆, 返回 ErrorSignCount
+func (rp *RelyingPartyMgr) VerifyAssertion(challenge string, publicKey []byte, signCount uint32, response *AssertionResponse) (uint32, error) {
+	fields, err := decodeFields(response.Response.ClientDataJSON, response.Response.AuthenticatorData, response.Response.Signature)
+	if err != nil {
+		return 0, err
+	}
+
+	clientData, err := ParseClientData(fields[0])
+	if err != nil {
+		return 0, err
+	}
+	if err = rp.checkClientData(clientData, "webauthn.get", challenge); err != nil {
+		return 0, err
+	}
+
+	data, err := parseAuthData(fields[1])
+	if err != nil {
+		return 0, err
+	}
+	if err = rp.checkAuthData(data); err != nil {
+		return 0, err
+	}
+
+	key, err := ParsePublicKey(publicKey)
+	if err != nil {
+		return 0, err
+	}
+	clientDataHash := sha256.Sum256(fields[0])
+	signed := append(append([]byte{}, fields[1]...), clientDataHash[:]...)
+	if !key.Verify(signed, fields[2]) {
+		return 0, ErrorSignature
+	}
+
+	if (data.signCount != 0 || signCount != 0) && data.signCount <= signCount {
+		return 0, ErrorSignCount
+	}
+	return data.signCount, nil
+}
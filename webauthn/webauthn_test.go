@@ -0,0 +1,375 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// testdata 中的注册和登录结果来自真实认证器, 取自 github.com/go-webauthn/webauthn 的测试数据(BSD-3-Clause)
+
+// touchIDPublicKey assertion_es256_touchid.json 对应凭证的 COSE 公钥
+const touchIDPublicKey = "pQMmIAEhWCAoCF-x0dwEhzQo-ABxHIAgr_5WL6cJceREc81oIwFn7iJYIHEHx8ZhBIE42L26-rSC_3l0ZaWEmsHAKyP9rgslApUdAQI"
+
+func loadFixture(t *testing.T, name string, v interface{}) {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustDecode(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := Encoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestVerifyRegistration(t *testing.T) {
+	tests := []struct {
+		name      string
+		fixture   string
+		rpID      string
+		origin    string
+		challenge string
+		mutate    func(response *AttestationResponse)
+		alg       int
+		signCount uint32
+		err       error
+	}{
+		{
+			name:      "packed self attestation ES256",
+			fixture:   "packed_self_macos.json",
+			rpID:      "localhost",
+			origin:    "http://localhost:9005",
+			challenge: "rWiex8xDOPfiCgyFu4BLW6vVOmXKgPwHrlMCgEs9SBA",
+			alg:       AlgES256,
+			signCount: 1553021388,
+		},
+		{
+			name:      "none attestation ES256",
+			fixture:   "none_titan.json",
+			rpID:      "webauthn.io",
+			origin:    "https://webauthn.io",
+			challenge: "sVt4ScceMzqFSnfAq8hgLzblvo3fa4_aFVEcIESHIJ0",
+			alg:       AlgES256,
+		},
+		{
+			name:      "tpm attestation RS256",
+			fixture:   "tpm_rs256_windows_hello.json",
+			rpID:      "localhost",
+			origin:    "https://localhost:44329",
+			challenge: "gHrAk4pNe2VlB0HLeKclI2P6QEa83PuGeijTHMtpbhY9KlybyhlwF_VzRe7yhabXagWuY6rkDWfvvhNqgh2o7A",
+			alg:       AlgRS256,
+			signCount: 67,
+		},
+		{
+			name:      "unsupported algorithm RS1",
+			fixture:   "tpm_rs1_windows_hello.json",
+			rpID:      "localhost",
+			origin:    "https://localhost:44329",
+			challenge: "9JyUfJkg8PqoKZuD7FHzOE9dbyculC9urGTpGqBnEwnhKmni4rGRXxm3-ZBHK8x6riJQqIpC8qEa-T0qIFTKTQ",
+			err:       ErrorPublicKey,
+		},
+		{
+			name:      "challenge mismatch",
+			fixture:   "none_titan.json",
+			rpID:      "webauthn.io",
+			origin:    "https://webauthn.io",
+			challenge: "rWiex8xDOPfiCgyFu4BLW6vVOmXKgPwHrlMCgEs9SBA",
+			err:       ErrorClientData,
+		},
+		{
+			name:      "origin not allowed",
+			fixture:   "none_titan.json",
+			rpID:      "webauthn.io",
+			origin:    "https://example.com",
+			challenge: "sVt4ScceMzqFSnfAq8hgLzblvo3fa4_aFVEcIESHIJ0",
+			err:       ErrorClientData,
+		},
+		{
+			name:      "rp id mismatch",
+			fixture:   "none_titan.json",
+			rpID:      "example.com",
+			origin:    "https://webauthn.io",
+			challenge: "sVt4ScceMzqFSnfAq8hgLzblvo3fa4_aFVEcIESHIJ0",
+			err:       ErrorAuthData,
+		},
+		{
+			name:      "truncated attestation object",
+			fixture:   "none_titan.json",
+			rpID:      "webauthn.io",
+			origin:    "https://webauthn.io",
+			challenge: "sVt4ScceMzqFSnfAq8hgLzblvo3fa4_aFVEcIESHIJ0",
+			mutate: func(response *AttestationResponse) {
+				data, _ := Encoding.DecodeString(response.Response.AttestationObject)
+				response.Response.AttestationObject = Encoding.EncodeToString(data[:len(data)/2])
+			},
+			err: ErrorCBOR,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := &AttestationResponse{}
+			loadFixture(t, tt.fixture, response)
+			if tt.mutate != nil {
+				tt.mutate(response)
+			}
+
+			rp := New(&Config{RPID: tt.rpID, Origins: []string{tt.origin}})
+			credential, err := rp.VerifyRegistration(tt.challenge, response)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if credential.Algorithm != tt.alg || credential.SignCount != tt.signCount {
+				t.Fatalf("alg = %v signCount = %v, want %v %v", credential.Algorithm, credential.SignCount, tt.alg, tt.signCount)
+			}
+			if _, err = ParsePublicKey(credential.PublicKey); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestVerifyAssertionES256(t *testing.T) {
+	const challenge = "E4PTcIH_HfX1pC6Sigk1SC9NAlgeztN0439vi8z_c9k"
+
+	tests := []struct {
+		name      string
+		challenge string
+		signCount uint32
+		mutate    func(response *AssertionResponse)
+		err       error
+	}{
+		{
+			name:      "valid",
+			challenge: challenge,
+		},
+		{
+			name:      "sign count not increased",
+			challenge: challenge,
+			signCount: 1553097241,
+			err:       ErrorSignCount,
+		},
+		{
+			name:      "challenge mismatch",
+			challenge: "sVt4ScceMzqFSnfAq8hgLzblvo3fa4_aFVEcIESHIJ0",
+			err:       ErrorClientData,
+		},
+		{
+			name:      "tampered signature",
+			challenge: challenge,
+			mutate: func(response *AssertionResponse) {
+				data, _ := Encoding.DecodeString(response.Response.Signature)
+				data[len(data)-1] ^= 0x01
+				response.Response.Signature = Encoding.EncodeToString(data)
+			},
+			err: ErrorSignature,
+		},
+		{
+			name:      "tampered authenticator data",
+			challenge: challenge,
+			mutate: func(response *AssertionResponse) {
+				data, _ := Encoding.DecodeString(response.Response.AuthenticatorData)
+				data[36] ^= 0x01 // 签名计数
+				response.Response.AuthenticatorData = Encoding.EncodeToString(data)
+			},
+			err: ErrorSignature,
+		},
+		{
+			name:      "truncated authenticator data",
+			challenge: challenge,
+			mutate: func(response *AssertionResponse) {
+				data, _ := Encoding.DecodeString(response.Response.AuthenticatorData)
+				response.Response.AuthenticatorData = Encoding.EncodeToString(data[:36])
+			},
+			err: ErrorAuthData,
+		},
+	}
+
+	publicKey := mustDecode(t, touchIDPublicKey)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := &AssertionResponse{}
+			loadFixture(t, "assertion_es256_touchid.json", response)
+			if tt.mutate != nil {
+				tt.mutate(response)
+			}
+
+			rp := New(&Config{RPID: "webauthn.io", Origins: []string{"https://webauthn.io"}})
+			signCount, err := rp.VerifyAssertion(tt.challenge, publicKey, tt.signCount, response)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if signCount != 1553097241 {
+				t.Fatalf("signCount = %v", signCount)
+			}
+		})
+	}
+}
+
+// rsaAuthenticator 软件认证器 没有可用的真实 RS256 登录数据, 按认证器的格式生成
+type rsaAuthenticator struct {
+	key  *rsa.PrivateKey
+	rpID string
+}
+
+func (a *rsaAuthenticator) publicKey() []byte {
+	e := make([]byte, 4)
+	binary.BigEndian.PutUint32(e, uint32(a.key.E))
+	return rsaCOSEKey(a.key.N.Bytes(), e[1:])
+}
+
+func (a *rsaAuthenticator) assert(t *testing.T, challenge, origin string, flags byte, signCount uint32) *AssertionResponse {
+	t.Helper()
+	clientDataJSON, err := json.Marshal(&ClientData{Type: "webauthn.get", Challenge: challenge, Origin: origin})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	authenticatorData := append(rpIDHash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(authenticatorData[33:], signCount)
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authenticatorData...), clientDataHash[:]...))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := &AssertionResponse{Type: "public-key"}
+	response.Response.ClientDataJSON = Encoding.EncodeToString(clientDataJSON)
+	response.Response.AuthenticatorData = Encoding.EncodeToString(authenticatorData)
+	response.Response.Signature = Encoding.EncodeToString(signature)
+	return response
+}
+
+func TestVerifyAssertionRS256(t *testing.T) {
+	const (
+		rpID      = "example.com"
+		origin    = "https://example.com"
+		challenge = "Dw4NDAsKCQgHBgUEAwIBAA"
+	)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator := &rsaAuthenticator{key: key, rpID: rpID}
+
+	tests := []struct {
+		name      string
+		response  *AssertionResponse
+		signCount uint32
+		uv        string
+		err       error
+	}{
+		{
+			name:     "valid",
+			response: authenticator.assert(t, challenge, origin, flagUP|flagUV, 5),
+		},
+		{
+			name:     "counter not supported",
+			response: authenticator.assert(t, challenge, origin, flagUP, 0),
+		},
+		{
+			name:      "cloned authenticator",
+			response:  authenticator.assert(t, challenge, origin, flagUP, 5),
+			signCount: 5,
+			err:       ErrorSignCount,
+		},
+		{
+			name:     "user not present",
+			response: authenticator.assert(t, challenge, origin, 0, 5),
+			err:      ErrorNotPresent,
+		},
+		{
+			name:     "user not verified",
+			response: authenticator.assert(t, challenge, origin, flagUP, 5),
+			uv:       UserVerificationRequired,
+			err:      ErrorNotVerified,
+		},
+		{
+			name:     "rp id mismatch",
+			response: (&rsaAuthenticator{key: key, rpID: "evil.com"}).assert(t, challenge, origin, flagUP, 5),
+			err:      ErrorAuthData,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := New(&Config{RPID: rpID, Origins: []string{origin}, UserVerification: tt.uv})
+			signCount, err := rp.VerifyAssertion(challenge, authenticator.publicKey(), tt.signCount, tt.response)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := Encoding.DecodeString(tt.response.Response.AuthenticatorData)
+			if want := binary.BigEndian.Uint32(data[33:37]); signCount != want {
+				t.Fatalf("signCount = %v, want %v", signCount, want)
+			}
+		})
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp := New(&Config{RPID: rpID, Origins: []string{origin}})
+	response := (&rsaAuthenticator{key: other, rpID: rpID}).assert(t, challenge, origin, flagUP, 1)
+	if _, err = rp.VerifyAssertion(challenge, authenticator.publicKey(), 0, response); !errors.Is(err, ErrorSignature) {
+		t.Fatalf("signed by other key: err = %v, want %v", err, ErrorSignature)
+	}
+}
+
+func TestParseAuthDataTruncated(t *testing.T) {
+	for _, fixture := range []string{"packed_self_macos.json", "none_titan.json", "tpm_rs256_windows_hello.json"} {
+		response := &AttestationResponse{}
+		loadFixture(t, fixture, response)
+		v, _, err := cborDecode(mustDecode(t, response.Response.AttestationObject))
+		if err != nil {
+			t.Fatal(err)
+		}
+		authData := v.(map[interface{}]interface{})["authData"].([]byte)
+		if _, err = parseAuthData(authData); err != nil {
+			t.Fatalf("%v: %v", fixture, err)
+		}
+		for i := 0; i < len(authData); i++ {
+			if _, err = parseAuthData(authData[:i]); err == nil {
+				t.Fatalf("%v: truncated to %v bytes, want error", fixture, i)
+			}
+		}
+	}
+}